@@ -0,0 +1,625 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cachePath = adminPath + "/cache"
+
+// Cache represents response caching options for a mapping
+type Cache struct {
+	ForceTTL   string `json:"force_ttl"`
+	MaxEntries int    `json:"max_entries"`
+	MaxSize    int64  `json:"max_size"`
+	Dir        string `json:"dir"`
+}
+
+// cacheEntry is a stored response; entries sharing a url are told apart using their vary values
+type cacheEntry struct {
+	Status  int
+	Header  http.Header
+	Body    []byte
+	Vary    map[string]string
+	Stored  time.Time
+	Expires time.Time
+}
+
+type cacheStore interface {
+	get(key string) []*cacheEntry
+	set(key string, entries []*cacheEntry)
+	purge(key string)
+	purgeAll()
+}
+
+type httpCache struct {
+	forceTTL time.Duration
+	maxSize  int64
+	store    cacheStore
+}
+
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+func newHTTPCache(config Cache) (*httpCache, error) {
+	var (
+		err error
+		c   = new(httpCache)
+	)
+
+	if config.ForceTTL != "" {
+		if c.forceTTL, err = time.ParseDuration(config.ForceTTL); err != nil {
+			return nil, fmt.Errorf("invalid force_ttl %s: %s", config.ForceTTL, err)
+		} else if c.forceTTL < 0 {
+			return nil, fmt.Errorf("force_ttl must not be negative")
+		}
+	}
+
+	c.maxSize = config.MaxSize
+	if c.maxSize <= 0 {
+		c.maxSize = 10 << 20
+	}
+
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = 1000
+	}
+
+	if config.Dir == "" {
+		c.store = &memoryCacheStore{max: config.MaxEntries, entries: make(map[string][]*cacheEntry)}
+	} else {
+		dir := normalizePath(config.Dir, true)
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("cache dir %s: %s", dir, err)
+		}
+		c.store = &diskCacheStore{dir: dir}
+	}
+
+	return c, nil
+}
+
+// handler serves cacheable requests from the cache and stores cacheable responses of next
+func (c *httpCache) handler(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.RequestURI()
+		reqcc := parseCacheControl(r.Header)
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if r.Method != http.MethodOptions && r.Method != http.MethodTrace {
+				c.store.purge(key)
+			}
+			next.ServeHTTP(w, r)
+			return
+		} else if _, nostore := reqcc["no-store"]; nostore {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		entries := c.store.get(key)
+		entry := matchCacheEntry(entries, r)
+		_, nocache := reqcc["no-cache"]
+
+		if entry != nil && !nocache && time.Now().Before(entry.Expires) {
+			c.serve(w, r, entry)
+			return
+		}
+
+		if r.Method == http.MethodHead || (c.forceTTL == 0 && r.Header.Get("Authorization") != "") {
+			w.Header().Set("X-Cache", "MISS")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		creq := r
+		if entry != nil {
+			creq = r.Clone(r.Context())
+			if etag := entry.Header.Get("ETag"); etag != "" {
+				creq.Header.Set("If-None-Match", etag)
+			}
+			if lastmod := entry.Header.Get("Last-Modified"); lastmod != "" {
+				creq.Header.Set("If-Modified-Since", lastmod)
+			}
+		}
+
+		// headers set before next, e.g. by rate limiting, belong to gorexy and are never stored
+		cw := &cacheResponseWriter{ResponseWriter: w, max: c.maxSize, revalidating: entry != nil, before: w.Header().Clone()}
+		next.ServeHTTP(cw, creq)
+
+		if cw.revalidated {
+			updated := *entry
+			updated.Header = entry.Header.Clone()
+			for k, v := range cw.header {
+				updated.Header[k] = v
+			}
+			c.strip(updated.Header)
+			updated.Stored = time.Now()
+			updated.Expires = c.expires(updated.Status, updated.Header, updated.Stored)
+
+			var stored []*cacheEntry
+			for _, e := range entries {
+				if e == entry {
+					e = &updated
+				}
+				stored = append(stored, e)
+			}
+
+			c.store.set(key, stored)
+			c.serve(w, r, &updated)
+			return
+		}
+
+		if cw.overflow || !cw.wroteHeader {
+			return
+		}
+
+		stored := time.Now()
+		expires := c.expires(cw.status, cw.header, stored)
+		if expires.IsZero() {
+			return
+		}
+
+		vary, ok := varyValues(cw.header, r)
+		if !ok {
+			return
+		}
+
+		fresh := &cacheEntry{
+			Status:  cw.status,
+			Header:  cw.header,
+			Body:    cw.body.Bytes(),
+			Vary:    vary,
+			Stored:  stored,
+			Expires: expires,
+		}
+		fresh.Header.Del("X-Cache")
+		c.strip(fresh.Header)
+
+		var updated []*cacheEntry
+		for _, e := range entries {
+			if e != entry && !sameVary(e.Vary, vary) {
+				updated = append(updated, e)
+			}
+		}
+		c.store.set(key, append(updated, fresh))
+	})
+}
+
+// strip removes the headers which must not be stored: cookies are specific to a client, forced entries are served to all of them
+func (c *httpCache) strip(h http.Header) {
+	if c.forceTTL > 0 {
+		h.Del("Set-Cookie")
+	}
+}
+
+// serve writes a cached entry, answering conditional requests with 304 when possible
+func (c *httpCache) serve(w http.ResponseWriter, r *http.Request, entry *cacheEntry) {
+	h := w.Header()
+	for k, v := range entry.Header {
+		if k == "Set-Cookie" {
+			// cookies set by gorexy, e.g. by traffic splitting, are kept
+			h[k] = append(h[k], v...)
+		} else {
+			h[k] = v
+		}
+	}
+
+	h.Set("X-Cache", "HIT")
+	h.Set("Age", strconv.Itoa(int(time.Since(entry.Stored).Seconds())))
+
+	if etag := entry.Header.Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(entry.Status)
+	if r.Method != http.MethodHead {
+		w.Write(entry.Body)
+	}
+}
+
+// expires determines until when a response is fresh; a zero time means the response must not be stored
+func (c *httpCache) expires(status int, h http.Header, now time.Time) time.Time {
+	if !cacheableStatus[status] {
+		return time.Time{}
+	} else if mediatype, _, _ := mime.ParseMediaType(h.Get("Content-Type")); mediatype == "text/event-stream" {
+		return time.Time{}
+	} else if c.forceTTL > 0 {
+		return now.Add(c.forceTTL)
+	}
+
+	cc := parseCacheControl(h)
+	if _, ok := cc["no-store"]; ok {
+		return time.Time{}
+	} else if _, ok := cc["private"]; ok {
+		return time.Time{}
+	} else if h.Get("Set-Cookie") != "" {
+		return time.Time{}
+	}
+
+	// entries which must always be revalidated are stored already expired
+	stale := now.Add(-time.Nanosecond)
+	if _, ok := cc["no-cache"]; ok {
+		return stale
+	}
+
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[directive]; ok {
+			if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+				return now.Add(time.Duration(secs) * time.Second)
+			}
+			return stale
+		}
+	}
+
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		date = now
+	}
+
+	if v := h.Get("Expires"); v != "" {
+		if expires, err := http.ParseTime(v); err == nil && expires.After(date) {
+			return now.Add(expires.Sub(date))
+		}
+		return stale
+	}
+
+	if lastmod, err := http.ParseTime(h.Get("Last-Modified")); err == nil && lastmod.Before(date) {
+		heuristic := date.Sub(lastmod) / 10
+		if heuristic > 24*time.Hour {
+			heuristic = 24 * time.Hour
+		}
+		return now.Add(heuristic)
+	}
+
+	if h.Get("ETag") != "" {
+		return stale
+	}
+
+	return time.Time{}
+}
+
+func (c *httpCache) purge(url string) {
+	if url == "" {
+		c.store.purgeAll()
+	} else {
+		c.store.purge(url)
+	}
+}
+
+type cacheResponseWriter struct {
+	http.ResponseWriter
+	status       int
+	body         bytes.Buffer
+	max          int64
+	overflow     bool
+	wroteHeader  bool
+	revalidating bool
+	revalidated  bool
+	header       http.Header // response headers as received from next
+	before       http.Header // response headers set before next
+}
+
+// upstreamHeader returns the values of h which were not in before
+func upstreamHeader(h, before http.Header) http.Header {
+	upstream := make(http.Header)
+
+	for k, v := range h {
+		if prior := before[k]; len(prior) > 0 && len(v) >= len(prior) && strings.Join(v[:len(prior)], "\n") == strings.Join(prior, "\n") {
+			v = v[len(prior):]
+		}
+
+		if len(v) > 0 {
+			upstream[k] = append([]string{}, v...)
+		}
+	}
+
+	return upstream
+}
+
+func (w *cacheResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+	w.status = status
+	w.header = upstreamHeader(w.Header(), w.before)
+
+	// a 304 received while revalidating is kept from the client, which gets the cached entry instead
+	if w.revalidating && status == http.StatusNotModified {
+		w.revalidated = true
+		for k := range w.header {
+			if prior, ok := w.before[k]; ok {
+				w.Header()[k] = prior
+			} else {
+				delete(w.Header(), k)
+			}
+		}
+		return
+	}
+
+	w.Header().Set("X-Cache", "MISS")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.revalidated {
+		return len(b), nil
+	}
+
+	if !w.overflow {
+		if int64(w.body.Len()+len(b)) > w.max {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheResponseWriter) Flush() {
+	if w.revalidated {
+		return
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *cacheResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// parseCacheControl returns Cache-Control directives with their (unquoted) values
+func parseCacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+
+	for _, hdr := range h["Cache-Control"] {
+		for _, part := range strings.Split(hdr, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+
+			if i := strings.Index(part, "="); i != -1 {
+				cc[strings.ToLower(part[:i])] = strings.Trim(part[i+1:], `"`)
+			} else {
+				cc[strings.ToLower(part)] = ""
+			}
+		}
+	}
+
+	if _, ok := cc["no-cache"]; !ok && len(h["Cache-Control"]) == 0 && h.Get("Pragma") == "no-cache" {
+		cc["no-cache"] = ""
+	}
+
+	return cc
+}
+
+// varyValues returns the request headers selected by the Vary response header; false when the response varies on everything
+func varyValues(h http.Header, r *http.Request) (map[string]string, bool) {
+	values := make(map[string]string)
+
+	for _, hdr := range h["Vary"] {
+		for _, name := range strings.Split(hdr, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil, false
+			} else if name != "" {
+				values[name] = strings.Join(r.Header[name], ", ")
+			}
+		}
+	}
+
+	return values, true
+}
+
+func matchCacheEntry(entries []*cacheEntry, r *http.Request) *cacheEntry {
+	for _, e := range entries {
+		matches := true
+		for name, value := range e.Vary {
+			if strings.Join(r.Header[name], ", ") != value {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			return e
+		}
+	}
+
+	return nil
+}
+
+func sameVary(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+type memoryCacheStore struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string][]*cacheEntry
+}
+
+func (s *memoryCacheStore) get(key string) []*cacheEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.entries[key]
+}
+
+func (s *memoryCacheStore) set(key string, entries []*cacheEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = entries
+
+	// evict the least recently stored urls once the store is full
+	for len(s.entries) > s.max {
+		var (
+			oldest    string
+			oldestAge time.Time
+		)
+
+		for k, es := range s.entries {
+			for _, e := range es {
+				if oldest == "" || e.Stored.Before(oldestAge) {
+					oldest, oldestAge = k, e.Stored
+				}
+			}
+		}
+
+		delete(s.entries, oldest)
+	}
+}
+
+func (s *memoryCacheStore) purge(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+}
+
+func (s *memoryCacheStore) purgeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = make(map[string][]*cacheEntry)
+}
+
+type diskCacheStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func (s *diskCacheStore) filename(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".cache")
+}
+
+func (s *diskCacheStore) get(key string) []*cacheEntry {
+	var entries []*cacheEntry
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.filename(key))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	if err = gob.NewDecoder(f).Decode(&entries); err != nil {
+		log.Printf("[cache] invalid entry for %s: %s\n", key, err)
+		return nil
+	}
+
+	return entries
+}
+
+func (s *diskCacheStore) set(key string, entries []*cacheEntry) {
+	var buf bytes.Buffer
+
+	if err := gob.NewEncoder(&buf).Encode(entries); err != nil {
+		log.Printf("[cache] failed to encode %s: %s\n", key, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ioutil.WriteFile(s.filename(key), buf.Bytes(), 0644); err != nil {
+		log.Printf("[cache] failed to store %s: %s\n", key, err)
+	}
+}
+
+func (s *diskCacheStore) purge(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	os.Remove(s.filename(key))
+}
+
+func (s *diskCacheStore) purgeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, _ := filepath.Glob(filepath.Join(s.dir, "*.cache"))
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
+
+// purgeCache handles purge requests; mapping and url query parameters narrow down what is purged
+func purgeCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapping := r.URL.Query().Get("mapping")
+	url := r.URL.Query().Get("url")
+	purged := 0
+	htprox, _ := proxies.get()
+
+	for _, s := range htprox {
+		if s.Cache != nil && (mapping == "" || mapping == s.Prefix) {
+			s.Cache.purge(url)
+			purged++
+		}
+	}
+
+	if purged == 0 {
+		http.Error(w, "No cache found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("[cache purged] mapping=%q url=%q\n", mapping, url)
+	fmt.Fprintf(w, "Purged %d cache(s)\n", purged)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var defaultCompressionTypes = []string{
+	"text/html",
+	"text/css",
+	"text/plain",
+	"text/xml",
+	"text/javascript",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// Compression represents response compression options for a mapping
+type Compression struct {
+	Types   []string `json:"types"`
+	MinSize int      `json:"min_size"`
+	Level   int      `json:"level"`
+}
+
+type compressor struct {
+	types   []string
+	minSize int64
+	pool    sync.Pool
+}
+
+func newCompressor(config Compression) (*compressor, error) {
+	var c = new(compressor)
+
+	if config.Level == 0 {
+		config.Level = gzip.DefaultCompression
+	} else if config.Level < gzip.HuffmanOnly || config.Level > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid compression level %d", config.Level)
+	}
+
+	if config.MinSize < 0 {
+		return nil, fmt.Errorf("compression min_size must not be negative")
+	} else if config.MinSize == 0 {
+		config.MinSize = 1024
+	}
+
+	if len(config.Types) == 0 {
+		config.Types = defaultCompressionTypes
+	}
+
+	for _, t := range config.Types {
+		c.types = append(c.types, strings.ToLower(strings.TrimSpace(t)))
+	}
+
+	c.minSize = int64(config.MinSize)
+	c.pool.New = func() interface{} {
+		gz, _ := gzip.NewWriterLevel(nil, config.Level)
+		return gz
+	}
+
+	return c, nil
+}
+
+// handler compresses responses of next when the client accepts gzip
+func (c *compressor) handler(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || !acceptsEncoding(r, "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressResponseWriter{ResponseWriter: w, c: c}
+		defer cw.close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+func (c *compressor) compressible(contentType string) bool {
+	return matchesMediaType(c.types, contentType)
+}
+
+// matchesMediaType reports whether contentType is one of types, which may contain wildcards such as text/*; event streams never match
+func matchesMediaType(types []string, contentType string) bool {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediatype == "text/event-stream" {
+		return false
+	}
+
+	for _, t := range types {
+		if t == mediatype || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediatype, t[:len(t)-1])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type compressResponseWriter struct {
+	http.ResponseWriter
+	c       *compressor
+	gz      *gzip.Writer
+	decided bool
+}
+
+// start decides whether the response is compressed, based on its status and headers
+func (w *compressResponseWriter) start(status int) {
+	w.decided = true
+
+	h := w.Header()
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return
+	} else if status == http.StatusPartialContent || h.Get("Content-Range") != "" {
+		// ranges refer to the uncompressed body
+		return
+	} else if h.Get("Content-Encoding") != "" || !w.c.compressible(h.Get("Content-Type")) {
+		return
+	} else if cl := h.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n < w.c.minSize {
+			return
+		}
+	}
+
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	h.Set("Content-Encoding", "gzip")
+	h.Add("Vary", "Accept-Encoding")
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+
+	w.gz = w.c.pool.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if !w.decided {
+		w.start(status)
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends compressed data written so far, so streamed responses are never held back
+func (w *compressResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressResponseWriter) close() {
+	if w.gz == nil {
+		return
+	}
+
+	w.gz.Close()
+	w.gz.Reset(nil)
+	w.c.pool.Put(w.gz)
+	w.gz = nil
+}
+
+// acceptsEncoding determines whether the client accepts a content coding, according to Accept-Encoding
+func acceptsEncoding(r *http.Request, coding string) bool {
+	accepted := false
+
+	for _, hdr := range r.Header["Accept-Encoding"] {
+		for _, part := range strings.Split(hdr, ",") {
+			name, q := part, 1.0
+			if i := strings.Index(part, ";"); i != -1 {
+				name = part[:i]
+				param := strings.TrimSpace(part[i+1:])
+				if strings.HasPrefix(param, "q=") {
+					if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						q = v
+					}
+				}
+			}
+
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == coding {
+				return q > 0
+			} else if name == "*" {
+				accepted = q > 0
+			}
+		}
+	}
+
+	return accepted
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// cookieRewriter adapts Set-Cookie headers of a destination to the way it is reached through gorexy
+type cookieRewriter struct {
+	domains     map[string]string
+	paths       []cookiePath
+	stripSecure bool
+}
+
+type cookiePath struct {
+	from string
+	to   string
+}
+
+// newCookieRewriter returns nil when mapping does not rewrite cookies
+func newCookieRewriter(mapping Mapping) *cookieRewriter {
+	if len(mapping.CookieDomainRewrite) == 0 && len(mapping.CookiePathRewrite) == 0 && !mapping.CookieStripSecure {
+		return nil
+	}
+
+	c := &cookieRewriter{domains: make(map[string]string), stripSecure: mapping.CookieStripSecure}
+
+	for from, to := range mapping.CookieDomainRewrite {
+		c.domains[strings.ToLower(strings.TrimPrefix(from, "."))] = to
+	}
+
+	for from, to := range mapping.CookiePathRewrite {
+		c.paths = append(c.paths, cookiePath{from: from, to: to})
+	}
+
+	// longest prefixes first
+	sort.Slice(c.paths, func(i, j int) bool { return len(c.paths[i].from) > len(c.paths[j].from) })
+
+	return c
+}
+
+// modifyResponse is meant to be used as the ModifyResponse hook of a reverse proxy
+func (c *cookieRewriter) modifyResponse(res *http.Response) error {
+	cookies := res.Header["Set-Cookie"]
+	if len(cookies) == 0 {
+		return nil
+	}
+
+	plain := res.Request != nil && res.Request.TLS == nil && !strings.EqualFold(res.Request.Header.Get("X-Forwarded-Proto"), "https")
+
+	for i, cookie := range cookies {
+		cookies[i] = c.rewrite(cookie, plain)
+	}
+
+	return nil
+}
+
+func (c *cookieRewriter) rewrite(cookie string, plain bool) string {
+	parts := strings.Split(cookie, ";")
+	kept := parts[:1]
+
+	for _, part := range parts[1:] {
+		attr := strings.TrimSpace(part)
+		name, value := attr, ""
+		if i := strings.Index(attr, "="); i >= 0 {
+			name, value = strings.TrimSpace(attr[:i]), strings.TrimSpace(attr[i+1:])
+		}
+
+		switch strings.ToLower(name) {
+		case "domain":
+			to, ok := c.domains[strings.ToLower(strings.TrimPrefix(value, "."))]
+			if !ok {
+				to, ok = c.domains["*"]
+			}
+
+			if ok {
+				if to == "" {
+					// host-only cookie
+					continue
+				}
+				attr = "Domain=" + to
+			}
+		case "path":
+			attr = "Path=" + c.path(value)
+		case "secure":
+			if plain && c.stripSecure {
+				continue
+			}
+		case "samesite":
+			// SameSite=None is rejected by browsers without Secure
+			if plain && c.stripSecure && strings.EqualFold(value, "none") {
+				continue
+			}
+		}
+
+		kept = append(kept, " "+attr)
+	}
+
+	return strings.Join(kept, ";")
+}
+
+// path applies the longest matching rewrite; a rule for /app applies to /app and /app/..., not to /application
+func (c *cookieRewriter) path(path string) string {
+	for _, p := range c.paths {
+		if path == p.from {
+			return p.to
+		}
+
+		if !strings.HasPrefix(path, p.from) {
+			continue
+		}
+
+		rest := path[len(p.from):]
+		if strings.HasSuffix(p.from, "/") {
+			return strings.TrimSuffix(p.to, "/") + "/" + rest
+		} else if strings.HasPrefix(rest, "/") {
+			return strings.TrimSuffix(p.to, "/") + rest
+		}
+	}
+
+	return path
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fluxynet/gorexy/wsutils"
+)
+
+const faultsPath = adminPath + "/faults"
+
+// Faults represents faults injected into the requests of a mapping
+type Faults struct {
+	Enabled        *bool   `json:"enabled,omitempty"`
+	Latency        string  `json:"latency,omitempty"`
+	Jitter         string  `json:"jitter,omitempty"`
+	ErrorRate      float64 `json:"error_rate,omitempty"`
+	ErrorStatus    int     `json:"error_status,omitempty"`
+	ErrorBody      string  `json:"error_body,omitempty"`
+	AbortRate      float64 `json:"abort_rate,omitempty"`
+	TruncateRate   float64 `json:"truncate_rate,omitempty"`
+	TruncateAt     int     `json:"truncate_at,omitempty"`
+	WSDropAfter    string  `json:"ws_drop_after,omitempty"`
+	WSDropMessages int     `json:"ws_drop_messages,omitempty"`
+}
+
+type faultSettings struct {
+	Faults
+	enabled     bool
+	latency     time.Duration
+	jitter      time.Duration
+	wsDropAfter time.Duration
+}
+
+type faultInjector struct {
+	mu       sync.RWMutex
+	settings faultSettings
+}
+
+func newFaultInjector(config Faults) (*faultInjector, error) {
+	f := new(faultInjector)
+	if err := f.set(config); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// set validates and applies config, replacing the previous faults
+func (f *faultInjector) set(config Faults) error {
+	var (
+		err error
+		s   = faultSettings{Faults: config, enabled: config.Enabled == nil || *config.Enabled}
+	)
+
+	for _, d := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"latency", config.Latency, &s.latency},
+		{"jitter", config.Jitter, &s.jitter},
+		{"ws_drop_after", config.WSDropAfter, &s.wsDropAfter},
+	} {
+		if d.value == "" {
+			continue
+		} else if *d.dest, err = time.ParseDuration(d.value); err != nil {
+			return fmt.Errorf("invalid %s %s: %s", d.name, d.value, err)
+		}
+	}
+
+	for _, r := range []struct {
+		name  string
+		value float64
+	}{
+		{"error_rate", config.ErrorRate},
+		{"abort_rate", config.AbortRate},
+		{"truncate_rate", config.TruncateRate},
+	} {
+		if r.value < 0 || r.value > 1 {
+			return fmt.Errorf("%s must be between 0 and 1", r.name)
+		}
+	}
+
+	if s.ErrorStatus == 0 {
+		s.ErrorStatus = http.StatusServiceUnavailable
+	} else if s.ErrorStatus < 100 || s.ErrorStatus > 999 {
+		return fmt.Errorf("invalid error_status %d", s.ErrorStatus)
+	}
+
+	f.mu.Lock()
+	f.settings = s
+	f.mu.Unlock()
+
+	return nil
+}
+
+func (f *faultInjector) get() faultSettings {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.settings
+}
+
+func (f *faultInjector) enable(enabled bool) {
+	f.mu.Lock()
+	f.settings.enabled = enabled
+	f.settings.Enabled = &enabled
+	f.mu.Unlock()
+}
+
+// handler injects the currently configured faults in front of next
+func (f *faultInjector) handler(next http.Handler) http.Handler {
+	if f == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := f.get()
+		if !s.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if delay := s.delay(); delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if chance(s.ErrorRate) {
+			log.Printf("[fault] error %d %s\n", s.ErrorStatus, r.URL.Path)
+			w.WriteHeader(s.ErrorStatus)
+			if s.ErrorBody == "" {
+				fmt.Fprintf(w, "Fault injected for prefix: %s", r.URL.Path)
+			} else {
+				fmt.Fprint(w, s.ErrorBody)
+			}
+			return
+		}
+
+		if wsutils.Upgrade(r) != "" {
+			messages := s.WSDropMessages
+			if !wsutils.IsWebsocket(r) {
+				// other protocols have no messages to count
+				messages = 0
+			}
+
+			if s.wsDropAfter > 0 || messages > 0 {
+				w = &faultHijacker{ResponseWriter: w, after: s.wsDropAfter, messages: messages, path: r.URL.Path}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if chance(s.AbortRate) {
+			log.Printf("[fault] abort %s\n", r.URL.Path)
+			fw := &faultResponseWriter{ResponseWriter: w, abort: true}
+			next.ServeHTTP(fw, r)
+
+			// only the handler goroutine may abort, writes may come from others such as flush timers
+			if fw.aborted {
+				panic(http.ErrAbortHandler)
+			}
+			return
+		} else if chance(s.TruncateRate) {
+			log.Printf("[fault] truncate %s\n", r.URL.Path)
+			w = &faultResponseWriter{ResponseWriter: w, limit: s.TruncateAt}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s faultSettings) delay() time.Duration {
+	delay := s.latency
+	if s.jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(2*s.jitter))) - s.jitter
+	}
+
+	return delay
+}
+
+func chance(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+// errFaultAbort is returned by writes once an aborted response has been cut
+var errFaultAbort = errors.New("response aborted by fault injection")
+
+// faultCutSize is where bodies of unknown length are cut when truncate_at is not set
+const faultCutSize = 1024
+
+// faultResponseWriter cuts the body short, either closing the connection (abort) or ending the response early (truncate)
+type faultResponseWriter struct {
+	http.ResponseWriter
+	limit       int // bytes written before cutting the body; half of the Content-Length when 0
+	written     int
+	abort       bool
+	aborted     bool
+	wroteHeader bool
+}
+
+func (w *faultResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+	if w.limit == 0 {
+		if length, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil {
+			w.limit = length / 2
+		} else {
+			w.limit = faultCutSize
+		}
+	}
+
+	if !w.abort {
+		w.Header().Del("Content-Length")
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *faultResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.aborted {
+		return 0, errFaultAbort
+	}
+
+	if remaining := w.limit - w.written; remaining < len(b) {
+		if remaining > 0 {
+			w.ResponseWriter.Write(b[:remaining])
+			w.written += remaining
+		}
+
+		if w.abort {
+			w.Flush()
+			w.aborted = true
+			return remaining, errFaultAbort
+		}
+
+		return len(b), nil
+	}
+
+	w.written += len(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *faultResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *faultResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// faultHijacker hands out connections which are dropped after a duration or number of messages
+type faultHijacker struct {
+	http.ResponseWriter
+	after    time.Duration
+	messages int
+	path     string
+}
+
+func (h *faultHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := h.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("not a hijacker")
+	}
+
+	nc, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// data already buffered by the server must still go through the connection
+	var reader io.Reader = nc
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered, _ := brw.Reader.Peek(n)
+		reader = io.MultiReader(bytes.NewReader(append([]byte{}, buffered...)), nc)
+	}
+
+	fc := h.conn(nc, reader, false)
+
+	return fc, bufio.NewReadWriter(bufio.NewReader(fc), bufio.NewWriter(fc)), nil
+}
+
+// WrapConn applies the faults to connections of HTTP/2 streams, which start after the handshake
+func (h *faultHijacker) WrapConn(c net.Conn) net.Conn {
+	return h.conn(c, c, true)
+}
+
+func (h *faultHijacker) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
+
+func (h *faultHijacker) conn(nc net.Conn, reader io.Reader, upgraded bool) *faultConn {
+	fc := &faultConn{Conn: nc, reader: reader, limit: h.messages, path: h.path, upgraded: upgraded}
+	if h.after > 0 {
+		fc.timer = time.AfterFunc(h.after, func() { fc.drop("after " + h.after.String()) })
+	}
+
+	return fc
+}
+
+type faultConn struct {
+	net.Conn
+	reader   io.Reader
+	path     string
+	timer    *time.Timer
+	once     sync.Once
+	limit    int
+	mu       sync.Mutex
+	messages int
+	in       wsutils.MessageCounter
+	out      wsutils.MessageCounter
+	upgraded bool
+	tail     uint32
+}
+
+func (c *faultConn) Read(b []byte) (int, error) {
+	n, err := c.reader.Read(b)
+	c.count(c.in.Count(b[:n]))
+
+	return n, err
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.count(c.out.Count(c.skipHandshake(b[:n])))
+
+	return n, err
+}
+
+// skipHandshake returns the part of b following the handshake response written to the client
+func (c *faultConn) skipHandshake(b []byte) []byte {
+	if c.upgraded {
+		return b
+	}
+
+	for i, ch := range b {
+		c.tail = c.tail<<8 | uint32(ch)
+		if c.tail == 0x0d0a0d0a {
+			c.upgraded = true
+			return b[i+1:]
+		}
+	}
+
+	return nil
+}
+
+func (c *faultConn) count(n int) {
+	if c.limit <= 0 || n == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	c.messages += n
+	drop := c.messages >= c.limit
+	c.mu.Unlock()
+
+	if drop {
+		c.drop("after messages")
+	}
+}
+
+func (c *faultConn) drop(reason string) {
+	c.once.Do(func() {
+		log.Printf("[fault] websocket dropped %s %s\n", reason, c.path)
+		c.Conn.Close()
+	})
+}
+
+func (c *faultConn) Close() error {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes the underlying connection, so that faults do not turn a half-close into a close
+func (c *faultConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Close()
+}
+
+// faultsHandler lists faults of all mappings, or updates those of one mapping
+func faultsHandler(w http.ResponseWriter, r *http.Request) {
+	type mappingFaults struct {
+		Mapping  string         `json:"mapping"`
+		Enabled  bool           `json:"enabled"`
+		Faults   Faults         `json:"faults"`
+		injector *faultInjector `json:"-"`
+	}
+
+	var (
+		list    []mappingFaults
+		mapping = r.URL.Query().Get("mapping")
+	)
+
+	add := func(prefix string, f *faultInjector) {
+		if f != nil && (mapping == "" || mapping == prefix) {
+			s := f.get()
+			list = append(list, mappingFaults{Mapping: prefix, Enabled: s.enabled, Faults: s.Faults, injector: f})
+		}
+	}
+
+	htprox, wsprox := proxies.get()
+	for _, s := range htprox {
+		add(s.Prefix, s.Faults)
+	}
+
+	for _, s := range wsprox {
+		add(s.Prefix, s.Faults)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case http.MethodPost, http.MethodPut:
+		if mapping == "" {
+			http.Error(w, "mapping is required", http.StatusBadRequest)
+			return
+		} else if len(list) == 0 {
+			http.Error(w, "No faults found for mapping "+mapping, http.StatusNotFound)
+			return
+		}
+
+		if r.ContentLength != 0 {
+			var config Faults
+			if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+				http.Error(w, "Invalid faults: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			for _, m := range list {
+				if err := m.injector.set(config); err != nil {
+					http.Error(w, "Invalid faults: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		if enabled := r.URL.Query().Get("enabled"); enabled != "" {
+			e, err := strconv.ParseBool(enabled)
+			if err != nil {
+				http.Error(w, "Invalid enabled: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			for _, m := range list {
+				m.injector.enable(e)
+			}
+		}
+
+		log.Printf("[faults updated] %s enabled=%t\n", mapping, list[0].injector.get().enabled)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
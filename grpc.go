@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+const (
+	h2cMapping  = "h2c"
+	grpcMapping = "grpc"
+
+	grpcStatusUnavailable = "14"
+)
+
+// h2cTransport speaks HTTP/2 without TLS (prior knowledge) to upstreams
+var h2cTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetUnencryptedHTTP2(true)
+
+	return t
+}()
+
+// grpcErrorHandler answers with a trailers-only gRPC response, so that clients get an UNAVAILABLE status instead of a bare 502
+func grpcErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", grpcStatusUnavailable)
+	w.Header().Set("Grpc-Message", url.PathEscape("gorexy: "+err.Error()))
+	w.WriteHeader(http.StatusOK)
+}
+
+// listenerProtocols returns the protocols accepted by gorexy's listeners; HTTP/2 is accepted with and without TLS
+func listenerProtocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(true)
+
+	return p
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+	grpcWebTrailerFlag     = 0x80
+)
+
+// grpcWebHandler translates gRPC-Web requests from browsers into gRPC calls to next; other requests are left untouched
+func grpcWebHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			grpcWebCORS(w, r)
+			w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		contentType := r.Header.Get("Content-Type")
+		if !strings.HasPrefix(contentType, grpcWebContentType) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		text := strings.HasPrefix(contentType, grpcWebTextContentType)
+		suffix := strings.TrimPrefix(strings.TrimPrefix(contentType, grpcWebTextContentType), grpcWebContentType)
+
+		r.Header.Set("Content-Type", "application/grpc"+suffix)
+		r.Header.Set("Te", "trailers")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+
+		if text {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{&base64Reader{r: r.Body}, r.Body}
+		}
+
+		grpcWebCORS(w, r)
+
+		gw := &grpcWebResponseWriter{w: w, header: make(http.Header), text: text, contentType: contentType}
+		next.ServeHTTP(gw, r)
+		gw.finish()
+	})
+}
+
+func grpcWebCORS(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set("Access-Control-Expose-Headers", "Grpc-Status, Grpc-Message, Grpc-Status-Details-Bin")
+		w.Header().Add("Vary", "Origin")
+	}
+}
+
+// grpcWebResponseWriter receives a gRPC response and writes it as gRPC-Web: trailers are sent as the last frame of the body
+type grpcWebResponseWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	text        bool
+	contentType string
+	wroteHeader bool
+	wroteBody   bool
+	announced   []string
+}
+
+func (gw *grpcWebResponseWriter) Header() http.Header {
+	return gw.header
+}
+
+func (gw *grpcWebResponseWriter) WriteHeader(status int) {
+	if gw.wroteHeader {
+		return
+	}
+
+	gw.wroteHeader = true
+
+	for _, v := range gw.header["Trailer"] {
+		for _, name := range strings.Split(v, ",") {
+			gw.announced = append(gw.announced, http.CanonicalHeaderKey(strings.TrimSpace(name)))
+		}
+	}
+
+	h := gw.w.Header()
+	for k, v := range gw.header {
+		switch k {
+		case "Trailer", "Content-Length":
+			continue
+		case "Content-Type":
+			h.Set(k, gw.contentType)
+		default:
+			h[k] = v
+		}
+	}
+
+	gw.w.WriteHeader(status)
+}
+
+func (gw *grpcWebResponseWriter) Write(b []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+
+	gw.wroteBody = true
+
+	if gw.text {
+		if _, err := gw.w.Write([]byte(base64.StdEncoding.EncodeToString(b))); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	return gw.w.Write(b)
+}
+
+func (gw *grpcWebResponseWriter) Flush() {
+	if f, ok := gw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish writes the trailer frame; trailers-only responses already carry their status in the headers
+func (gw *grpcWebResponseWriter) finish() {
+	var lines []string
+
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+
+	if !gw.wroteBody && gw.w.Header().Get("Grpc-Status") != "" {
+		return
+	}
+
+	for _, name := range gw.announced {
+		for _, v := range gw.header[name] {
+			lines = append(lines, fmt.Sprintf("%s: %s\r\n", strings.ToLower(name), v))
+		}
+	}
+
+	for k, values := range gw.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			for _, v := range values {
+				lines = append(lines, fmt.Sprintf("%s: %s\r\n", strings.ToLower(strings.TrimPrefix(k, http.TrailerPrefix)), v))
+			}
+		}
+	}
+
+	sort.Strings(lines)
+	trailers := strings.Join(lines, "")
+
+	frame := make([]byte, 5, 5+len(trailers))
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(trailers)))
+	frame = append(frame, trailers...)
+
+	gw.Write(frame)
+	gw.Flush()
+}
+
+// base64Reader decodes a stream of base64 chunks, each of which may be padded
+type base64Reader struct {
+	r       io.Reader
+	encoded []byte
+	decoded []byte
+	err     error
+}
+
+func (b *base64Reader) Read(p []byte) (int, error) {
+	for len(b.decoded) == 0 {
+		if b.err != nil {
+			if b.err == io.EOF && len(b.encoded) > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, b.err
+		}
+
+		chunk := make([]byte, 4096)
+		n, err := b.r.Read(chunk)
+		b.err = err
+
+		for _, c := range chunk[:n] {
+			if c != '\r' && c != '\n' {
+				b.encoded = append(b.encoded, c)
+			}
+		}
+
+		quads := len(b.encoded) / 4 * 4
+		for i := 0; i < quads; i += 4 {
+			var out [3]byte
+			m, err := base64.StdEncoding.Decode(out[:], b.encoded[i:i+4])
+			if err != nil {
+				return 0, err
+			}
+			b.decoded = append(b.decoded, out[:m]...)
+		}
+		b.encoded = b.encoded[quads:]
+	}
+
+	n := copy(p, b.decoded)
+	b.decoded = b.decoded[n:]
+
+	return n, nil
+}
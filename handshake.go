@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// wsHandshake checks and routes the websocket handshakes of a mapping before they are forwarded
+type wsHandshake struct {
+	origins   []*regexp.Regexp
+	origin    string
+	protocols map[string]http.Handler
+}
+
+// newWSHandshake returns nil when the mapping has no handshake options
+func newWSHandshake(mapping Mapping) (*wsHandshake, error) {
+	if len(mapping.WSOrigins) == 0 && mapping.WSOrigin == "" && len(mapping.WSProtocols) == 0 {
+		return nil, nil
+	}
+
+	h := &wsHandshake{origin: mapping.WSOrigin, protocols: make(map[string]http.Handler)}
+
+	for _, origin := range mapping.WSOrigins {
+		// * matches any part of an origin, e.g. https://*.example.com
+		pattern := strings.Replace(regexp.QuoteMeta(strings.TrimRight(origin, "/")), `\*`, ".*", -1)
+		h.origins = append(h.origins, regexp.MustCompile("(?i)^"+pattern+"$"))
+	}
+
+	for protocol, destination := range mapping.WSProtocols {
+		target, err := url.Parse(parsePorts(destination))
+		if err != nil {
+			return nil, fmt.Errorf("invalid url %s: %s", destination, err)
+		}
+
+		switch target.Scheme {
+		case wsMapping, "wss", httpMapping, "https":
+		default:
+			return nil, fmt.Errorf("destination of protocol %s must be a ws or http url", protocol)
+		}
+
+		proxy, err := newUpgradeProxy(target, mapping)
+		if err != nil {
+			return nil, err
+		}
+		h.protocols[protocol] = proxy
+	}
+
+	return h, nil
+}
+
+// wrap applies the handlers of the mapping, e.g. faults, to the destinations of protocols
+func (h *wsHandshake) wrap(wrap func(http.Handler) http.Handler) {
+	if h == nil {
+		return
+	}
+
+	for protocol, handler := range h.protocols {
+		h.protocols[protocol] = wrap(handler)
+	}
+}
+
+// allow rejects handshakes from origins which are not allowed; requests without an origin do not come from browsers and are allowed
+func (h *wsHandshake) allow(w http.ResponseWriter, r *http.Request) bool {
+	if h == nil || len(h.origins) == 0 {
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, o := range h.origins {
+		if o.MatchString(origin) {
+			return true
+		}
+	}
+
+	log.Printf("[websocket origin rejected] %s: %s\n", r.URL.Path, origin)
+	http.Error(w, "Origin not allowed", http.StatusForbidden)
+
+	return false
+}
+
+// route rewrites the origin of r and returns the destination of the first subprotocol requested by r which has one, next otherwise
+func (h *wsHandshake) route(r *http.Request, next http.Handler) http.Handler {
+	if h == nil {
+		return next
+	}
+
+	if h.origin != "" {
+		r.Header.Set("Origin", h.origin)
+	}
+
+	for _, v := range r.Header["Sec-Websocket-Protocol"] {
+		for _, protocol := range strings.Split(v, ",") {
+			if handler, ok := h.protocols[strings.TrimSpace(protocol)]; ok {
+				return handler
+			}
+		}
+	}
+
+	return next
+}
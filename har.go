@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	recordMode = "record"
+	replayMode = "replay"
+	redacted   = "[REDACTED]"
+)
+
+// Record represents the options of record and replay modes
+type Record struct {
+	File        string   `json:"file"`
+	MaxBodySize int      `json:"max_body_size"`
+	Redact      []string `json:"redact"`
+}
+
+type har struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size        int    `json:"size"`
+	Compression int    `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harRecorder struct {
+	file    string
+	maxBody int
+	redact  map[string]bool
+
+	mu    sync.Mutex
+	har   har
+	dirty bool
+
+	saving sync.Mutex // the file is written when flushing and on shutdown
+}
+
+func newHARRecorder(config Record) *harRecorder {
+	rec := &harRecorder{
+		file:    config.File,
+		maxBody: config.MaxBodySize,
+		redact:  redactedHeaders(config.Redact),
+	}
+
+	rec.har.Log = harLog{Version: "1.2", Creator: harCreator{Name: "gorexy", Version: "1.0"}, Entries: []harEntry{}}
+
+	go rec.flush()
+
+	return rec
+}
+
+func redactedHeaders(names []string) map[string]bool {
+	if names == nil {
+		names = []string{"Authorization", "Cookie", "Set-Cookie"}
+	}
+
+	redact := make(map[string]bool)
+	for _, n := range names {
+		redact[http.CanonicalHeaderKey(n)] = true
+	}
+
+	return redact
+}
+
+// flush writes the recorded session every second, when it changed
+func (rec *harRecorder) flush() {
+	for range time.Tick(time.Second) {
+		rec.write()
+	}
+}
+
+// write saves the recorded session when it changed since it was last saved
+func (rec *harRecorder) write() {
+	rec.saving.Lock()
+	defer rec.saving.Unlock()
+
+	rec.mu.Lock()
+	if !rec.dirty {
+		rec.mu.Unlock()
+		return
+	}
+
+	data, err := json.MarshalIndent(rec.har, "", "  ")
+	rec.dirty = false
+	rec.mu.Unlock()
+
+	if err == nil {
+		err = ioutil.WriteFile(rec.file+".tmp", data, 0644)
+	}
+
+	if err == nil {
+		err = os.Rename(rec.file+".tmp", rec.file)
+	}
+
+	if err != nil {
+		log.Printf("[record failed] %s: %s\n", rec.file, err)
+	}
+}
+
+// handler records requests and responses of next
+func (rec *harRecorder) handler(next http.Handler) http.Handler {
+	if rec == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody *cappedBuffer
+
+		started := time.Now()
+		entry := harEntry{StartedDateTime: started, Request: rec.request(r)}
+
+		if r.Body != nil && r.Body != http.NoBody {
+			reqBody = &cappedBuffer{max: rec.maxBody}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, reqBody), r.Body}
+		}
+
+		rw := &recordResponseWriter{ResponseWriter: w, body: cappedBuffer{max: rec.maxBody}, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		if !rw.wroteHeader {
+			rw.headerAt = time.Now()
+		}
+
+		finished := time.Now()
+
+		if reqBody != nil {
+			entry.Request.BodySize = reqBody.size
+			mimetype := r.Header.Get("Content-Type")
+			entry.Request.PostData = &harPostData{MimeType: mimetype, Text: reqBody.buf.String()}
+		}
+
+		entry.Response = rec.response(rw)
+		entry.Timings = harTimings{
+			Send:    0,
+			Wait:    milliseconds(rw.headerAt.Sub(started)),
+			Receive: milliseconds(finished.Sub(rw.headerAt)),
+		}
+		entry.Time = milliseconds(finished.Sub(started))
+
+		rec.mu.Lock()
+		rec.har.Log.Entries = append(rec.har.Log.Entries, entry)
+		rec.dirty = true
+		rec.mu.Unlock()
+	})
+}
+
+func (rec *harRecorder) request(r *http.Request) harRequest {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	req := harRequest{
+		Method:      r.Method,
+		URL:         scheme + "://" + r.Host + r.URL.RequestURI(),
+		HTTPVersion: r.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     rec.headers(r.Header),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+	}
+
+	for k, values := range r.URL.Query() {
+		for _, v := range values {
+			req.QueryString = append(req.QueryString, harNameValue{Name: k, Value: v})
+		}
+	}
+
+	for _, c := range r.Cookies() {
+		value := c.Value
+		if rec.redact["Cookie"] {
+			value = redacted
+		}
+		req.Cookies = append(req.Cookies, harNameValue{Name: c.Name, Value: value})
+	}
+
+	return req
+}
+
+func (rec *harRecorder) response(rw *recordResponseWriter) harResponse {
+	h := rw.Header()
+	body := rw.body.buf.Bytes()
+	res := harResponse{
+		Status:      rw.status,
+		StatusText:  http.StatusText(rw.status),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []harNameValue{},
+		Headers:     rec.headers(h),
+		RedirectURL: h.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    rw.body.size,
+	}
+
+	res.Content.MimeType = h.Get("Content-Type")
+	res.Content.Size = rw.body.size
+
+	// har content is decoded; gzip bodies are stored uncompressed
+	if strings.EqualFold(h.Get("Content-Encoding"), "gzip") && !rw.body.truncated {
+		if gz, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			if decoded, err := ioutil.ReadAll(gz); err == nil {
+				res.Content.Size = len(decoded)
+				res.Content.Compression = len(decoded) - len(body)
+				body = decoded
+			}
+		}
+	}
+
+	if utf8.Valid(body) {
+		res.Content.Text = string(body)
+	} else {
+		res.Content.Text = base64.StdEncoding.EncodeToString(body)
+		res.Content.Encoding = "base64"
+	}
+
+	if rw.body.truncated {
+		res.Content.Comment = fmt.Sprintf("truncated to %d bytes", rec.maxBody)
+	}
+
+	return res
+}
+
+func (rec *harRecorder) headers(h http.Header) []harNameValue {
+	headers := []harNameValue{}
+
+	for k, values := range h {
+		for _, v := range values {
+			if rec.redact[http.CanonicalHeaderKey(k)] {
+				v = redacted
+			}
+			headers = append(headers, harNameValue{Name: k, Value: v})
+		}
+	}
+
+	return headers
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// cappedBuffer keeps at most max bytes (everything when max is 0) while counting all of them
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	size      int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.size += len(p)
+
+	if keep := b.max - b.buf.Len(); b.max > 0 && keep < len(p) {
+		if keep > 0 {
+			b.buf.Write(p[:keep])
+		}
+		b.truncated = true
+		return len(p), nil
+	}
+
+	return b.buf.Write(p)
+}
+
+type recordResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	body        cappedBuffer
+	wroteHeader bool
+	headerAt    time.Time
+}
+
+func (w *recordResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = status
+		w.headerAt = time.Now()
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *recordResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// harReplayer serves recorded responses; requests recorded more than once are answered in turn
+type harReplayer struct {
+	mu      sync.Mutex
+	entries map[string][]harEntry
+	served  map[string]int
+	redact  map[string]bool
+}
+
+func newHARReplayer(config Record) (*harReplayer, error) {
+	var h har
+
+	data, err := ioutil.ReadFile(config.File)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("invalid har file %s: %s", config.File, err)
+	}
+
+	rep := &harReplayer{
+		entries: make(map[string][]harEntry),
+		served:  make(map[string]int),
+		redact:  redactedHeaders(config.Redact),
+	}
+
+	for _, e := range h.Log.Entries {
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			continue
+		}
+
+		for _, key := range []string{e.Request.Method + " " + u.RequestURI(), e.Request.Method + " " + u.Path} {
+			rep.entries[key] = append(rep.entries[key], e)
+		}
+	}
+
+	log.Printf("[replay] %d entries loaded from %s\n", len(h.Log.Entries), config.File)
+
+	return rep, nil
+}
+
+func (rep *harReplayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		key     string
+		entries []harEntry
+	)
+
+	// an exact match is preferred, a match ignoring the query string is good enough otherwise
+	for _, key = range []string{r.Method + " " + r.URL.RequestURI(), r.Method + " " + r.URL.Path} {
+		if entries = rep.entries[key]; len(entries) > 0 {
+			break
+		}
+	}
+
+	if len(entries) == 0 {
+		http.Error(w, fmt.Sprintf("No recorded response for %s %s", r.Method, r.URL.RequestURI()), http.StatusNotFound)
+		return
+	}
+
+	rep.mu.Lock()
+	i := rep.served[key]
+	if i < len(entries)-1 {
+		rep.served[key]++
+	}
+	rep.mu.Unlock()
+
+	res := entries[i].Response
+	for _, h := range res.Headers {
+		switch http.CanonicalHeaderKey(h.Name) {
+		case "Content-Encoding", "Content-Length", "Transfer-Encoding", "Date":
+			continue
+		}
+
+		if h.Value == redacted && rep.redact[http.CanonicalHeaderKey(h.Name)] {
+			continue
+		}
+
+		w.Header().Add(h.Name, h.Value)
+	}
+
+	body := []byte(res.Content.Text)
+	if res.Content.Encoding == "base64" {
+		body, _ = base64.StdEncoding.DecodeString(res.Content.Text)
+	}
+
+	if w.Header().Get("Content-Type") == "" && res.Content.MimeType != "" {
+		if _, _, err := mime.ParseMediaType(res.Content.MimeType); err == nil {
+			w.Header().Set("Content-Type", res.Content.MimeType)
+		}
+	}
+
+	w.Header().Set("X-Gorexy-Replay", entries[i].StartedDateTime.Format(time.RFC3339))
+	w.WriteHeader(res.Status)
+	w.Write(body)
+}
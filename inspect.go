@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fluxynet/gorexy/wsutils"
+)
+
+const inspectPath = adminPath + "/inspect"
+
+// Inspect represents where websocket messages of inspected mappings are written
+type Inspect struct {
+	Console    bool   `json:"console"`
+	File       string `json:"file"`
+	MaxPayload int    `json:"max_payload"`
+}
+
+// InspectedMessage is a websocket message as written to the file and to the event stream
+type InspectedMessage struct {
+	Time       time.Time `json:"time"`
+	Mapping    string    `json:"mapping"`
+	Path       string    `json:"path"`
+	Client     string    `json:"client"`
+	Direction  string    `json:"direction"`
+	Opcode     string    `json:"opcode"`
+	Size       int       `json:"size"`
+	WireSize   int       `json:"wire_size"`
+	Frames     int       `json:"frames"`
+	Compressed bool      `json:"compressed,omitempty"`
+	Payload    string    `json:"payload"`
+	Truncated  bool      `json:"truncated,omitempty"`
+}
+
+// wsInspector writes the messages of inspected websocket connections to the console, a file and event stream clients
+type wsInspector struct {
+	console    bool
+	maxPayload int
+
+	mu      sync.Mutex
+	file    *os.File
+	clients map[chan sseEvent]string // mapping the client listens to, empty for all
+}
+
+var inspection *wsInspector
+
+func newWSInspector(config Inspect) (*wsInspector, error) {
+	in := &wsInspector{
+		console:    config.Console,
+		maxPayload: config.MaxPayload,
+		clients:    make(map[chan sseEvent]string),
+	}
+
+	if in.maxPayload <= 0 {
+		in.maxPayload = 256
+	}
+
+	if config.File != "" {
+		file, err := os.OpenFile(normalizePath(config.File, true), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		in.file = file
+	}
+
+	return in, nil
+}
+
+// inspect returns the function receiving the messages of the websocket connections of a mapping
+func (in *wsInspector) inspect(mapping string) func(r *http.Request, m wsutils.Message) {
+	return func(r *http.Request, m wsutils.Message) {
+		in.publish(in.message(mapping, r, m))
+	}
+}
+
+func (in *wsInspector) message(mapping string, r *http.Request, m wsutils.Message) InspectedMessage {
+	msg := InspectedMessage{
+		Time:       m.Time,
+		Mapping:    mapping,
+		Path:       r.URL.Path,
+		Client:     r.RemoteAddr,
+		Direction:  "server",
+		Opcode:     m.OpcodeName(),
+		Size:       len(m.Payload),
+		WireSize:   m.WireSize,
+		Frames:     m.Frames,
+		Compressed: m.Compressed,
+		Truncated:  m.Truncated,
+	}
+
+	if m.FromClient {
+		msg.Direction = "client"
+	}
+
+	if m.Truncated {
+		msg.Size = m.WireSize
+	}
+
+	payload := m.Payload
+	if m.Opcode == 0x8 && len(payload) >= 2 {
+		// close frames start with a status code, the reason follows
+		msg.Payload = strconv.Itoa(int(binary.BigEndian.Uint16(payload)))
+		if payload = payload[2:]; len(payload) > 0 {
+			msg.Payload += " "
+		}
+	}
+
+	if len(payload) > in.maxPayload {
+		payload = payload[:in.maxPayload]
+		msg.Truncated = true
+	}
+
+	if m.Opcode == 0x2 || !utf8.Valid(trimRune(payload)) {
+		msg.Payload += hex.EncodeToString(payload)
+	} else {
+		msg.Payload += string(trimRune(payload))
+	}
+
+	return msg
+}
+
+// trimRune drops the incomplete rune truncation may have left at the end of b
+func trimRune(b []byte) []byte {
+	for i := 0; i < utf8.UTFMax && len(b) > 0; i++ {
+		if utf8.Valid(b) {
+			return b
+		}
+		b = b[:len(b)-1]
+	}
+
+	return b
+}
+
+func (in *wsInspector) publish(msg InspectedMessage) {
+	data, _ := json.Marshal(msg)
+
+	if in.console {
+		arrow := "->"
+		if msg.Direction == "server" {
+			arrow = "<-"
+		}
+		log.Printf("[ws] %s %s %s %s %dB %q\n", msg.Mapping, msg.Client, arrow, msg.Opcode, msg.Size, msg.Payload)
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if in.file != nil {
+		if _, err := in.file.Write(append(data, '\n')); err != nil {
+			log.Printf("[ws inspect error] %s\n", err)
+		}
+	}
+
+	for c, mapping := range in.clients {
+		if mapping != "" && mapping != msg.Mapping {
+			continue
+		}
+
+		// slow clients lose messages rather than slowing connections down
+		select {
+		case c <- sseEvent{"message", data}:
+		default:
+		}
+	}
+}
+
+// ServeHTTP streams inspected messages, optionally of a single mapping, as server-sent events
+func (in *wsInspector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	messages := make(chan sseEvent, 64)
+
+	in.mu.Lock()
+	in.clients[messages] = r.URL.Query().Get("mapping")
+	in.mu.Unlock()
+
+	defer func() {
+		in.mu.Lock()
+		delete(in.clients, messages)
+		in.mu.Unlock()
+	}()
+
+	serveEvents(w, r, messages)
+}
+
+// inspectHandler streams the messages of inspected websocket connections
+func inspectHandler(w http.ResponseWriter, r *http.Request) {
+	if inspection == nil {
+		http.Error(w, "Inspection is not enabled", http.StatusNotFound)
+		return
+	}
+
+	inspection.ServeHTTP(w, r)
+}
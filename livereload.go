@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	liveReloadPath    = adminPath + "/livereload"
+	liveReloadFull    = "reload"
+	liveReloadCSS     = "css"
+	liveReloadTimeout = 30 * time.Second
+)
+
+// liveReloadScript listens to reload events of a mapping; css events only refresh stylesheets
+const liveReloadScript = `<script>(function(){` +
+	`if(!window.EventSource)return;` +
+	`var es=new EventSource(%s);` +
+	`es.addEventListener("reload",function(){location.reload()});` +
+	`es.addEventListener("css",function(){` +
+	`document.querySelectorAll('link[rel="stylesheet"]').forEach(function(l){` +
+	`var u=new URL(l.href);u.searchParams.set("livereload",Date.now());l.href=u.href})})` +
+	`})();</script>`
+
+// liveReloader notifies browsers showing pages of a mapping when they should reload
+type liveReloader struct {
+	mapping string
+	service string
+	target  string
+	inject  *rewriter
+
+	mu      sync.Mutex
+	clients map[chan sseEvent]bool
+	pending bool
+}
+
+func newLiveReloader(mapping Mapping, target *url.URL) (*liveReloader, error) {
+	l := &liveReloader{
+		mapping: mapping.Path,
+		service: mapping.LiveReloadService,
+		clients: make(map[chan sseEvent]bool),
+	}
+
+	if target != nil && target.Host != "" {
+		l.target = target.Host
+		if target.Port() == "" {
+			l.target = net.JoinHostPort(target.Hostname(), "80")
+		}
+	}
+
+	src, _ := json.Marshal(liveReloadPath + "?mapping=" + url.QueryEscape(mapping.Path))
+	script := fmt.Sprintf(liveReloadScript, src)
+
+	inject, err := newRewriter(Rewrite{
+		Types: []string{"text/html"},
+		Rules: []RewriteRule{{Find: `(?is)^(.*)</body>`, Replace: "${1}" + strings.Replace(script, "$", "$$", -1) + "</body>", Regex: true}},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	l.inject = inject
+
+	for _, dir := range mapping.LiveReloadWatch {
+		if err := l.watch(normalizePath(dir, true)); err != nil {
+			return nil, fmt.Errorf("cannot watch %s: %s", dir, err)
+		}
+	}
+
+	return l, nil
+}
+
+// handler injects the reload script in html responses of next
+func (l *liveReloader) handler(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+
+	return l.inject.handler(next)
+}
+
+// watch sends reload events when files under dir change; stylesheets are reloaded on their own
+func (l *liveReloader) watch(dir string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		var (
+			timer *time.Timer
+			mu    sync.Mutex
+			event string
+		)
+
+		defer watcher.Close()
+		for {
+			select {
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				} else if e.Op == fsnotify.Chmod {
+					continue
+				}
+
+				if e.Op&fsnotify.Create != 0 {
+					if info, err := os.Stat(e.Name); err == nil && info.IsDir() {
+						watcher.Add(e.Name)
+					}
+				}
+
+				// editors write several events per save, they are sent as one
+				mu.Lock()
+				if strings.EqualFold(filepath.Ext(e.Name), ".css") && event != liveReloadFull {
+					event = liveReloadCSS
+				} else {
+					event = liveReloadFull
+				}
+
+				if timer == nil {
+					timer = time.AfterFunc(100*time.Millisecond, func() {
+						mu.Lock()
+						ev := event
+						event, timer = "", nil
+						mu.Unlock()
+						l.broadcast(ev)
+					})
+				}
+				mu.Unlock()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("[livereload watch error] %s: %s\n", dir, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// restarted sends a reload event once the destination accepts connections again
+func (l *liveReloader) restarted(service string) {
+	if l.service != "" && l.service != service {
+		return
+	}
+
+	l.mu.Lock()
+	if l.pending {
+		l.mu.Unlock()
+		return
+	}
+	l.pending = true
+	l.mu.Unlock()
+
+	go func() {
+		deadline := time.Now().Add(liveReloadTimeout)
+
+		// the previous process may still be going away
+		time.Sleep(200 * time.Millisecond)
+
+		for l.target != "" && time.Now().Before(deadline) {
+			if c, err := net.DialTimeout("tcp", l.target, time.Second); err == nil {
+				c.Close()
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		l.mu.Lock()
+		l.pending = false
+		l.mu.Unlock()
+
+		l.broadcast(liveReloadFull)
+	}()
+}
+
+func (l *liveReloader) broadcast(event string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.clients) > 0 && !silent {
+		log.Printf("[livereload] %s: %s sent to %d clients\n", l.mapping, event, len(l.clients))
+	}
+
+	for c := range l.clients {
+		select {
+		case c <- sseEvent{event, []byte(event)}:
+		default:
+		}
+	}
+}
+
+// ServeHTTP streams reload events to a browser
+func (l *liveReloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	events := make(chan sseEvent, 1)
+
+	l.mu.Lock()
+	l.clients[events] = true
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		delete(l.clients, events)
+		l.mu.Unlock()
+	}()
+
+	serveEvents(w, r, events)
+}
+
+// liveReloadHandler serves reload events of the mapping given as query parameter
+func liveReloadHandler(w http.ResponseWriter, r *http.Request) {
+	mapping := r.URL.Query().Get("mapping")
+	htprox, _ := proxies.get()
+
+	for _, s := range htprox {
+		if s.LiveReload != nil && s.Prefix == mapping {
+			s.LiveReload.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	http.Error(w, fmt.Sprintf("No livereload for mapping %s", mapping), http.StatusNotFound)
+}
+
+// liveReloadRestarted notifies mappings that service has been restarted
+func liveReloadRestarted(service string) {
+	htprox, _ := proxies.get()
+	for _, s := range htprox {
+		if s.LiveReload != nil {
+			s.LiveReload.restarted(service)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"go/build"
@@ -11,27 +12,40 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fluxynet/gorexy/wsutils"
+	"github.com/fluxynet/gorexy/wsutils/xconnect"
 	"github.com/fsnotify/fsnotify"
 )
 
 const httpMapping = "http"
 const wsMapping = "ws"
 
+// shutdownTimeout is how long requests in flight, and services, are given to complete when gorexy stops
+const shutdownTimeout = 5 * time.Second
+
+// adminPath is reserved for gorexy's own endpoints and is never forwarded
+const adminPath = "/__gorexy"
+
 //Config represents application configuration as loaded from gorexy.json
 type Config struct {
 	Mappings []Mapping `json:"mappings"`
 	Services []Service `json:"services"`
+	Streams  []Stream  `json:"streams"`
 	Port     int       `json:"port"`
 	Silent   bool      `json:"silent"`
+	Throttle Throttle  `json:"throttle"`
+	Record   Record    `json:"record"`
+	Inspect  Inspect   `json:"inspect"`
 	HTTPS    struct {
 		Enabled  bool   `json:"enabled"`
 		Certfile string `json:"cert"`
@@ -42,8 +56,37 @@ type Config struct {
 
 //Mapping represents a proxy mapping
 type Mapping struct {
-	Path        string `json:"path"`
-	Destination string `json:"destination"`
+	Path          string       `json:"path"`
+	Destination   string       `json:"destination"`
+	RateLimit     *RateLimit   `json:"rate_limit"`
+	Compression   *Compression `json:"compression"`
+	Cache         *Cache       `json:"cache"`
+	Mock          *Mock        `json:"mock"`
+	Faults        *Faults      `json:"faults"`
+	Throttle      string       `json:"throttle"`
+	Shadow        *Shadow      `json:"shadow"`
+	GRPCWeb       bool         `json:"grpc_web"`
+	FlushInterval string       `json:"flush_interval"`
+	Timeout       string       `json:"timeout"`
+	IdleTimeout   string       `json:"idle_timeout"`
+	DialTimeout   string       `json:"dial_timeout"`
+	KeepAlive     string       `json:"keepalive"`
+	Split         *Split       `json:"split"`
+	Rewrite       *Rewrite     `json:"rewrite"`
+	Inspect       bool         `json:"inspect"`
+	WSMock        *WSMock      `json:"ws_mock"`
+
+	WSOrigins   []string          `json:"ws_origins"`
+	WSOrigin    string            `json:"ws_origin"`
+	WSProtocols map[string]string `json:"ws_protocols"`
+
+	CookieDomainRewrite map[string]string `json:"cookie_domain_rewrite"`
+	CookiePathRewrite   map[string]string `json:"cookie_path_rewrite"`
+	CookieStripSecure   bool              `json:"cookie_strip_secure"`
+
+	LiveReload        bool     `json:"livereload"`
+	LiveReloadService string   `json:"livereload_service"`
+	LiveReloadWatch   []string `json:"livereload_watch"`
 }
 
 //Service represents a service to start
@@ -55,28 +98,50 @@ type Service struct {
 	Args       string `json:"args"`
 	AutoReload bool   `json:"auto_reload"`
 	Silent     bool   `json:"silent"`
+
+	Restart        string `json:"restart"`
+	MaxRetries     int    `json:"max_retries"`
+	RestartBackoff string `json:"restart_backoff"`
 }
 
 // HTTPProxy represents an http proxy service with a corresponding prefix
 type HTTPProxy struct {
-	Prefix string
-	Proxy  *httputil.ReverseProxy
+	Prefix      string
+	Destination *url.URL
+	Proxy       *httputil.ReverseProxy
+	Handler     http.Handler
+	Limiter     *rateLimiter
+	Cache       *httpCache
+	Faults      *faultInjector
+	Shadow      *shadowMirror
+	Upgrade     http.Handler
+
+	LiveReload *liveReloader
+	Handshake  *wsHandshake
 }
 
 // WSProxy represents a websocket proxy service with a corresponding prefix
 type WSProxy struct {
-	Prefix string
-	Proxy  *wsutils.ReverseProxy
+	Prefix      string
+	Destination *url.URL
+	Proxy       *wsutils.ReverseProxy
+	Handler     http.Handler
+	Limiter     *rateLimiter
+	Faults      *faultInjector
+
+	Handshake *wsHandshake
 }
 
 var (
 	mapping map[string]string
-	htprox  []HTTPProxy
-	wsprox  []WSProxy
+	proxies = new(proxyList)
 	ports   map[string]string
 	port    int
 	silent  bool
 
+	throttling *throttler
+	recording  *harRecorder
+
 	portRegex = regexp.MustCompile(`(?m)\{PORT(?P<port>[0-9]+)\}`)
 
 	gopath = func() string {
@@ -95,18 +160,49 @@ var (
 	}()
 )
 
+//proxyList holds the proxies of the mappings, they are read by requests as well as by the supervisors of services
+type proxyList struct {
+	mu     sync.RWMutex
+	htprox []HTTPProxy
+	wsprox []WSProxy
+}
+
+func (l *proxyList) set(htprox []HTTPProxy, wsprox []WSProxy) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.htprox, l.wsprox = htprox, wsprox
+}
+
+//get returns the http and websocket proxies, they must not be modified
+func (l *proxyList) get() ([]HTTPProxy, []WSProxy) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.htprox, l.wsprox
+}
+
 func main() {
 	var (
 		err      error
 		config   *Config
-		wg       sync.WaitGroup
 		filename string
+		mode     string
+		args     = os.Args[1:]
 	)
 
-	if len(os.Args[1:]) == 0 {
+	// services must not inherit the setting enabling websockets over HTTP/2
+	xconnect.Restore()
+
+	if len(args) > 0 && (args[0] == recordMode || args[0] == replayMode) {
+		mode = args[0]
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
 		filename = "gorexy.json"
 	} else {
-		filename = os.Args[1]
+		filename = args[0]
 	}
 
 	config, err = loadConfig(normalizePath(filename, true))
@@ -118,28 +214,101 @@ func main() {
 		config.Port = 8000
 	}
 
+	if len(args) > 1 {
+		config.Record.File = args[1]
+	} else if config.Record.File == "" {
+		config.Record.File = "gorexy.har"
+	}
+	config.Record.File = normalizePath(config.Record.File, true)
+
+	if config.Record.MaxBodySize <= 0 {
+		config.Record.MaxBodySize = 1 << 20
+	}
+
+	http.HandleFunc(cachePath, purgeCache)
+	http.HandleFunc(faultsPath, faultsHandler)
+	http.HandleFunc(shadowPath, shadowHandler)
+	http.HandleFunc(streamsPath, streamsHandler)
+	http.HandleFunc(liveReloadPath, liveReloadHandler)
+	http.HandleFunc(inspectPath, inspectHandler)
+	http.HandleFunc(websocketsPath, websocketsHandler)
+
+	if mode == replayMode {
+		replayer, err := newHARReplayer(config.Record)
+		if err != nil {
+			log.Fatalf("Failed to load recording: %s", err)
+		}
+
+		http.Handle("/", replayer)
+		serve(config)
+		return
+	}
+
+	if mode == recordMode {
+		recording = newHARRecorder(config.Record)
+		log.Printf("[recording] %s\n", config.Record.File)
+	}
+
 	ports = initPorts(config.Port, config.Services)
 	silent = config.Silent
 
 	for _, service := range config.Services {
 		if e := startService(service); e != nil {
-			log.Fatalf("Failed to start service [%s]: %s", service.Name, err)
+			log.Fatalf("Failed to start service [%s]: %s", service.Name, e)
+		}
+	}
+
+	throttling, err = newThrottler(config.Throttle)
+	if err != nil {
+		log.Fatalf("Invalid throttle: %s", err)
+	}
+
+	for _, m := range config.Mappings {
+		if m.Inspect {
+			inspection, err = newWSInspector(config.Inspect)
+			if err != nil {
+				log.Fatalf("Invalid inspect: %s", err)
+			}
+			break
 		}
 	}
 
-	htprox, wsprox, err = createProxies(config.Mappings)
+	htprox, wsprox, err := createProxies(config.Mappings)
 	if err != nil {
 		log.Fatalf("Invalid mapping: %s", err)
 	}
+	proxies.set(htprox, wsprox)
+
+	streams, err = startStreams(config.Streams, config.HTTPS.Certfile, config.HTTPS.Keyfile)
+	if err != nil {
+		log.Fatalf("Invalid stream: %s", err)
+	}
 
 	http.HandleFunc("/", forwarder)
+	serve(config)
+}
+
+// serve listens on the http and https ports until both servers stop
+func serve(config *Config) {
+	var (
+		wg      sync.WaitGroup
+		servers []*http.Server
+		stopped = make(chan struct{})
+		stop    = make(chan os.Signal, 1)
+	)
+
+	if !xconnect.Enabled() {
+		log.Printf("[websockets] HTTP/2 websockets are disabled by GODEBUG, browsers will use HTTP/1.1 for them\n")
+	}
 
 	if !config.HTTPS.Enabled || !config.HTTPS.NoHTTP {
 		wg.Add(1)
 		port := strconv.Itoa(config.Port)
+		server := newServer(":" + port)
+		servers = append(servers, server)
 		go func() {
-			e := http.ListenAndServe(":"+port, nil)
-			if e != nil {
+			e := server.ListenAndServe()
+			if e != nil && e != http.ErrServerClosed {
 				fmt.Println("Error serving http: ", e)
 			}
 			wg.Done()
@@ -150,9 +319,11 @@ func main() {
 	if config.HTTPS.Enabled {
 		wg.Add(1)
 		port := strconv.Itoa(config.Port + 1)
+		server := newServer(":" + port)
+		servers = append(servers, server)
 		go func() {
-			e := http.ListenAndServeTLS(":"+port, normalizePath(config.HTTPS.Certfile, true), normalizePath(config.HTTPS.Keyfile, true), nil)
-			if e != nil {
+			e := server.ListenAndServeTLS(normalizePath(config.HTTPS.Certfile, true), normalizePath(config.HTTPS.Keyfile, true))
+			if e != nil && e != http.ErrServerClosed {
 				fmt.Println("Error serving https: ", e)
 			}
 			wg.Done()
@@ -160,24 +331,91 @@ func main() {
 		log.Printf("HTTPS listening on : https://127.0.0.1:%s\n", port)
 	}
 
-	wg.Wait()
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case sig := <-stop:
+		log.Printf("[stopping] %s\n", sig)
+		shutdown(servers)
+	case <-stopped:
+	}
+
 	log.Println("Server stopped")
 }
 
+//newServer returns a server listening on addr with the protocols and timeouts of gorexy
+func newServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Protocols:         listenerProtocols(),
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		IdleTimeout:       serverIdleTimeout,
+	}
+}
+
+//shutdown lets requests in flight complete, records them and stops services
+func shutdown(servers []*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			server.Shutdown(ctx)
+		}(server)
+	}
+	wg.Wait()
+
+	if recording != nil {
+		recording.write()
+	}
+
+	stopServices()
+}
+
 func forwarder(w http.ResponseWriter, r *http.Request) {
-	if wsutils.IsWebsocket(r) {
+	htprox, wsprox := proxies.get()
+	upgrade := wsutils.Upgrade(r)
+
+	// explicit ws:// mappings take websockets before http:// mappings do
+	websocket := upgrade != "" && wsutils.IsWebsocket(r)
+
+	if websocket {
 		for _, s := range wsprox {
 			if strings.HasPrefix(r.URL.Path, s.Prefix) {
-				s.Proxy.ServeHTTP(w, r)
+				if s.Handshake.allow(w, r) && s.Limiter.allow(w, r) {
+					s.Handshake.route(r, s.Handler).ServeHTTP(w, r)
+				}
 				return
 			}
 		}
-	} else {
-		for _, s := range htprox {
-			if strings.HasPrefix(r.URL.Path, s.Prefix) {
-				s.Proxy.ServeHTTP(w, r)
+	}
+
+	for _, s := range htprox {
+		if strings.HasPrefix(r.URL.Path, s.Prefix) {
+			if websocket && !s.Handshake.allow(w, r) {
 				return
 			}
+
+			if !s.Limiter.allow(w, r) {
+				return
+			}
+
+			if websocket && s.Upgrade != nil {
+				s.Handshake.route(r, s.Upgrade).ServeHTTP(w, r)
+			} else if upgrade != "" && s.Upgrade != nil {
+				s.Upgrade.ServeHTTP(w, r)
+			} else {
+				s.Handler.ServeHTTP(w, r)
+			}
+			return
 		}
 	}
 
@@ -221,12 +459,21 @@ func createProxies(mappings []Mapping) ([]HTTPProxy, []WSProxy, error) {
 	)
 
 	for i, mapping := range mappings {
-		var url *url.URL
+		var (
+			url       *url.URL
+			limiter   *rateLimiter
+			faults    *faultInjector
+			handshake *wsHandshake
+		)
 
 		if mapping.Path == "" {
 			return nil, nil, fmt.Errorf("mapping path not found at element %d", i+1)
 		}
 
+		if mapping.Destination == "" && mapping.Split != nil && len(mapping.Split.Destinations) > 0 {
+			mapping.Destination = mapping.Split.Destinations[0].Destination
+		}
+
 		if mapping.Destination == "" {
 			return nil, nil, fmt.Errorf("mapping destination not found at element %d", i+1)
 		}
@@ -238,11 +485,202 @@ func createProxies(mappings []Mapping) ([]HTTPProxy, []WSProxy, error) {
 			return nil, nil, fmt.Errorf("invalid url %s: %s", mapping.Destination, err)
 		}
 
-		if url.Scheme == httpMapping {
-			htprox = append(htprox, HTTPProxy{Prefix: mapping.Path, Proxy: httputil.NewSingleHostReverseProxy(url)})
-		} else if url.Scheme == wsMapping {
-			wsprox = append(wsprox, WSProxy{Prefix: mapping.Path, Proxy: wsutils.NewReverseProxy(url)})
-		} else {
+		if mapping.RateLimit != nil {
+			limiter, err = newRateLimiter(*mapping.RateLimit)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid rate_limit for %s: %s", mapping.Path, err)
+			}
+		}
+
+		if mapping.Faults != nil {
+			faults, err = newFaultInjector(*mapping.Faults)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid faults for %s: %s", mapping.Path, err)
+			}
+		}
+
+		if err = throttling.validate(mapping.Throttle); err != nil {
+			return nil, nil, fmt.Errorf("invalid throttle for %s: %s", mapping.Path, err)
+		}
+
+		if mapping.Split != nil && url.Scheme != httpMapping {
+			return nil, nil, fmt.Errorf("split requires an http destination for %s", mapping.Path)
+		}
+
+		if mapping.GRPCWeb && url.Scheme != grpcMapping {
+			return nil, nil, fmt.Errorf("grpc_web requires a grpc destination for %s", mapping.Path)
+		}
+
+		if mapping.Inspect && url.Scheme != httpMapping && url.Scheme != wsMapping {
+			return nil, nil, fmt.Errorf("inspect requires an http or ws destination for %s", mapping.Path)
+		}
+
+		if handshake, err = newWSHandshake(mapping); err != nil {
+			return nil, nil, fmt.Errorf("invalid websocket handshake options for %s: %s", mapping.Path, err)
+		} else if handshake != nil && url.Scheme != httpMapping && url.Scheme != wsMapping && url.Scheme != wsMockMapping {
+			return nil, nil, fmt.Errorf("websocket handshake options require an http, ws or ws-mock destination for %s", mapping.Path)
+		}
+
+		handshake.wrap(func(h http.Handler) http.Handler {
+			return faults.handler(throttling.handler(h, mapping.Throttle))
+		})
+
+		switch url.Scheme {
+		case httpMapping, mockMapping, h2cMapping, grpcMapping:
+			var (
+				compress *compressor
+				rewrite  *rewriter
+				live     *liveReloader
+				cache    *httpCache
+				shadow   *shadowMirror
+				proxy    *httputil.ReverseProxy
+				handler  http.Handler
+				upgrader http.Handler
+			)
+
+			if mapping.Compression != nil {
+				compress, err = newCompressor(*mapping.Compression)
+				if err != nil {
+					return nil, nil, fmt.Errorf("invalid compression for %s: %s", mapping.Path, err)
+				}
+			}
+
+			if mapping.Rewrite != nil {
+				if url.Scheme != httpMapping {
+					return nil, nil, fmt.Errorf("rewrite requires an http destination for %s", mapping.Path)
+				}
+
+				origins := []string{mapping.Destination}
+				if mapping.Split != nil {
+					origins = nil
+					for _, d := range mapping.Split.Destinations {
+						origins = append(origins, parsePorts(d.Destination))
+					}
+				}
+
+				rewrite, err = newRewriter(*mapping.Rewrite, origins)
+				if err != nil {
+					return nil, nil, fmt.Errorf("invalid rewrite for %s: %s", mapping.Path, err)
+				}
+			}
+
+			if mapping.LiveReload {
+				if url.Scheme == grpcMapping {
+					return nil, nil, fmt.Errorf("livereload is not supported on grpc destinations for %s", mapping.Path)
+				}
+
+				live, err = newLiveReloader(mapping, url)
+				if err != nil {
+					return nil, nil, fmt.Errorf("invalid livereload for %s: %s", mapping.Path, err)
+				}
+			}
+
+			if mapping.Cache != nil {
+				cache, err = newHTTPCache(*mapping.Cache)
+				if err != nil {
+					return nil, nil, fmt.Errorf("invalid cache for %s: %s", mapping.Path, err)
+				}
+			}
+
+			if mapping.Shadow != nil {
+				shadow, err = newShadowMirror(*mapping.Shadow)
+				if err != nil {
+					return nil, nil, fmt.Errorf("invalid shadow for %s: %s", mapping.Path, err)
+				}
+			}
+
+			switch url.Scheme {
+			case mockMapping:
+				if handler, err = newMockServer(mapping.Mock); err != nil {
+					return nil, nil, fmt.Errorf("invalid mock for %s: %s", mapping.Path, err)
+				}
+			case h2cMapping, grpcMapping:
+				scheme := url.Scheme
+				url.Scheme = httpMapping
+				proxy = httputil.NewSingleHostReverseProxy(url)
+				proxy.Transport = h2cTransport
+				proxy.FlushInterval = -1
+				handler = proxy
+				if scheme == grpcMapping {
+					proxy.ErrorHandler = grpcErrorHandler
+					if mapping.GRPCWeb {
+						handler = grpcWebHandler(proxy)
+					}
+				}
+			default:
+				if mapping.Split != nil {
+					var split *splitter
+					if split, err = newSplitter(*mapping.Split, mapping); err != nil {
+						return nil, nil, fmt.Errorf("invalid split for %s: %s", mapping.Path, err)
+					}
+					handler, upgrader = split, split
+					break
+				}
+
+				proxy = httputil.NewSingleHostReverseProxy(url)
+				handler = proxy
+				if upgrader, err = newUpgradeProxy(url, mapping); err != nil {
+					return nil, nil, fmt.Errorf("invalid websocket options for %s: %s", mapping.Path, err)
+				}
+			}
+
+			if upgrader != nil {
+				upgrader = faults.handler(throttling.handler(upgrader, mapping.Throttle))
+			}
+
+			if proxy != nil {
+				if err = configureStreaming(proxy, mapping); err != nil {
+					return nil, nil, fmt.Errorf("invalid streaming options for %s: %s", mapping.Path, err)
+				}
+
+				if cookies := newCookieRewriter(mapping); cookies != nil {
+					proxy.ModifyResponse = cookies.modifyResponse
+				}
+			}
+
+			htprox = append(htprox, HTTPProxy{
+				Prefix:      mapping.Path,
+				Destination: url,
+				Proxy:       proxy,
+				Handler:     recording.handler(faults.handler(throttling.handler(compress.handler(live.handler(rewrite.handler(cache.handler(shadow.handler(handler))))), mapping.Throttle))),
+				Limiter:     limiter,
+				Cache:       cache,
+				Faults:      faults,
+				Shadow:      shadow,
+				Upgrade:     upgrader,
+
+				LiveReload: live,
+				Handshake:  handshake,
+			})
+		case wsMapping:
+			proxy, err := newUpgradeProxy(url, mapping)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid websocket options for %s: %s", mapping.Path, err)
+			}
+			wsprox = append(wsprox, WSProxy{
+				Prefix:      mapping.Path,
+				Destination: url,
+				Proxy:       proxy,
+				Handler:     faults.handler(throttling.handler(proxy, mapping.Throttle)),
+				Limiter:     limiter,
+				Faults:      faults,
+
+				Handshake: handshake,
+			})
+		case wsMockMapping:
+			mock, err := newWSMockServer(mapping.WSMock, mapping.Path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid ws_mock for %s: %s", mapping.Path, err)
+			}
+			wsprox = append(wsprox, WSProxy{
+				Prefix:  mapping.Path,
+				Handler: faults.handler(throttling.handler(mock, mapping.Throttle)),
+				Limiter: limiter,
+				Faults:  faults,
+
+				Handshake: handshake,
+			})
+		default:
 			return nil, nil, fmt.Errorf("invalid mapping type %s for %s -> %s", url.Scheme, mapping.Path, mapping.Destination)
 		}
 	}
@@ -310,8 +748,6 @@ func normalizePath(path string, absolute bool) string {
 }
 
 func startService(service Service) error {
-	var cmd *exec.Cmd
-
 	if service.Cmd == "" {
 		return fmt.Errorf("cmd must not be empty")
 	}
@@ -347,59 +783,24 @@ func startService(service Service) error {
 		}
 	}
 
-	if service.Args == "" {
-		cmd = exec.Command(service.Cmd)
-	} else {
-		args := strings.Split(service.Args, " ")
-		cmd = exec.Command(service.Cmd, args...)
+	s, err := newSupervisor(service)
+	if err != nil {
+		return err
 	}
 
-	if service.Dir != "" {
-		cmd.Dir = service.Dir
-	}
+	supervisors.add(s)
+	s.start()
 
-	if service.Env != "" {
-		cmd.Env = strings.Split(service.Env, " ")
+	if service.AutoReload {
+		watchService(s)
 	}
 
-	go runCmd(cmd, service)
-
 	return nil
 }
 
-func runCmd(cmd *exec.Cmd, service Service) error {
-	var err error
-
-	if !silent && !service.Silent {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-	}
-
-	err = func() error {
-		var tries = 10
-		for {
-			cmd.Start()
-			if err == nil {
-				log.Printf("[started] %s\n", service.Name)
-				tries--
-				return nil
-			} else if tries == 0 {
-				log.Printf("[failed] %s - %s\n", service.Name, err)
-				return err
-			}
-
-			time.Sleep(time.Millisecond * 200)
-		}
-	}()
-
-	if service.AutoReload {
-		go watchService(service, cmd)
-	}
-
-	return err
-}
+func watchService(s *supervisor) {
+	service := s.service
 
-func watchService(service Service, cmd *exec.Cmd) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Fatalf("[watch failed] %s: %s", service.Name, err)
@@ -407,13 +808,18 @@ func watchService(service Service, cmd *exec.Cmd) {
 
 	go func() {
 		defer watcher.Close()
-		for {
-			select {
-			case <-watcher.Events:
-				log.Printf("[reloading] %s\n", service.Name)
-				cmd.Process.Kill()
-				startService(service)
-				return
+		for range watcher.Events {
+			log.Printf("[reloading] %s\n", service.Name)
+			s.reload()
+
+			// builds often replace the executable, which ends its watch
+			time.Sleep(200 * time.Millisecond)
+			for len(watcher.Events) > 0 {
+				<-watcher.Events
+			}
+			watcher.Remove(service.Cmd)
+			if err := watcher.Add(service.Cmd); err != nil {
+				log.Printf("[watch failed] %s: %s\n", service.Name, err)
 			}
 		}
 	}()
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const mockMapping = "mock"
+
+// Mock represents the responses of a mock mapping, defined inline or in fixture files
+type Mock struct {
+	Dir    string      `json:"dir"`
+	Routes []MockRoute `json:"routes"`
+}
+
+// MockRoute represents a mocked response and the requests it answers
+type MockRoute struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Query   map[string]string `json:"query"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	JSON    json.RawMessage   `json:"json"`
+	File    string            `json:"file"`
+	Delay   string            `json:"delay"`
+}
+
+// mockData is made available to body templates
+type mockData struct {
+	Method  string
+	Path    map[string]string
+	Query   map[string]string
+	Headers map[string]string
+	Body    interface{}
+}
+
+type mockRoute struct {
+	MockRoute
+	segments []string
+	delay    time.Duration
+	body     *template.Template
+	source   string
+}
+
+type mockServer struct {
+	dir    string
+	inline []*mockRoute
+
+	mu     sync.RWMutex
+	routes []*mockRoute
+}
+
+func newMockServer(config *Mock) (*mockServer, error) {
+	var (
+		err error
+		m   = new(mockServer)
+	)
+
+	if config == nil {
+		return nil, fmt.Errorf("mock must define dir or routes")
+	}
+
+	for i, r := range config.Routes {
+		route, err := compileMockRoute(r, "", fmt.Sprintf("route %d", i+1))
+		if err != nil {
+			return nil, err
+		}
+		m.inline = append(m.inline, route)
+	}
+
+	if config.Dir != "" {
+		m.dir = normalizePath(config.Dir, true)
+	}
+
+	if err = m.load(); err != nil {
+		return nil, err
+	}
+
+	if m.dir != "" {
+		if err = m.watch(); err != nil {
+			return nil, fmt.Errorf("failed to watch %s: %s", m.dir, err)
+		}
+	}
+
+	return m, nil
+}
+
+// load (re)reads fixture files; inline routes always take precedence
+func (m *mockServer) load() error {
+	routes := append([]*mockRoute{}, m.inline...)
+
+	if m.dir != "" {
+		files, err := filepath.Glob(filepath.Join(m.dir, "*.json"))
+		if err != nil {
+			return err
+		}
+		sort.Strings(files)
+
+		for _, file := range files {
+			fixtures, err := loadMockFixtures(file, m.dir)
+			if err != nil {
+				return err
+			}
+			routes = append(routes, fixtures...)
+		}
+	}
+
+	m.mu.Lock()
+	m.routes = routes
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *mockServer) watch() error {
+	return watchFixtures(m.dir, "mock", m.load)
+}
+
+// watchFixtures calls load whenever files of dir change
+func watchFixtures(dir, name string, load func() error) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				} else if event.Op == fsnotify.Chmod {
+					continue
+				}
+
+				if err := load(); err != nil {
+					log.Printf("[%s reload failed] %s: %s\n", name, dir, err)
+				} else {
+					log.Printf("[%s reloaded] %s\n", name, dir)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("[%s watch error] %s: %s\n", name, dir, err)
+			}
+		}
+	}()
+
+	return watcher.Add(dir)
+}
+
+func (m *mockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.RLock()
+	routes := m.routes
+	m.mu.RUnlock()
+
+	for _, route := range routes {
+		captures, ok := route.match(r)
+		if !ok {
+			continue
+		}
+
+		route.serve(w, r, captures)
+		return
+	}
+
+	http.Error(w, fmt.Sprintf("No mock found for %s %s", r.Method, r.URL.Path), http.StatusNotFound)
+}
+
+// loadMockFixtures reads a fixture file containing a single route or a list of routes
+func loadMockFixtures(file, dir string) ([]*mockRoute, error) {
+	var (
+		routes []MockRoute
+		result []*mockRoute
+	)
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		err = json.Unmarshal(data, &routes)
+	} else {
+		routes = make([]MockRoute, 1)
+		err = json.Unmarshal(data, &routes[0])
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid fixture %s: %s", file, err)
+	}
+
+	for i, r := range routes {
+		route, err := compileMockRoute(r, dir, fmt.Sprintf("%s route %d", filepath.Base(file), i+1))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, route)
+	}
+
+	return result, nil
+}
+
+func compileMockRoute(r MockRoute, dir, source string) (*mockRoute, error) {
+	var (
+		err   error
+		route = &mockRoute{MockRoute: r, source: source}
+		body  = r.Body
+	)
+
+	if r.Path == "" {
+		return nil, fmt.Errorf("mock %s: path must not be empty", source)
+	}
+
+	route.Method = strings.ToUpper(r.Method)
+	route.segments = strings.Split(strings.Trim(r.Path, "/"), "/")
+
+	if route.Status == 0 {
+		route.Status = http.StatusOK
+	}
+
+	if r.Delay != "" {
+		if route.delay, err = time.ParseDuration(r.Delay); err != nil {
+			return nil, fmt.Errorf("mock %s: invalid delay %s: %s", source, r.Delay, err)
+		}
+	}
+
+	if len(r.JSON) > 0 {
+		body = string(r.JSON)
+	} else if r.File != "" {
+		file := normalizePath(r.File, false)
+		if !filepath.IsAbs(file) && dir != "" {
+			file = filepath.Join(dir, file)
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("mock %s: %s", source, err)
+		}
+		body = string(data)
+	}
+
+	if route.body, err = template.New(source).Parse(body); err != nil {
+		return nil, fmt.Errorf("mock %s: invalid body template: %s", source, err)
+	}
+
+	return route, nil
+}
+
+// match checks method, path and query of r; path captures are returned on success
+func (route *mockRoute) match(r *http.Request) (map[string]string, bool) {
+	if route.Method != "" && route.Method != "*" && route.Method != r.Method {
+		return nil, false
+	}
+
+	query := r.URL.Query()
+	for k, v := range route.Query {
+		if _, exists := query[k]; !exists || (v != "" && v != "*" && query.Get(k) != v) {
+			return nil, false
+		}
+	}
+
+	captures := make(map[string]string)
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	for i, s := range route.segments {
+		if s == "*" && i == len(route.segments)-1 {
+			captures["*"] = strings.Join(segments[i:], "/")
+			return captures, true
+		} else if i >= len(segments) {
+			return nil, false
+		} else if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			captures[s[1:len(s)-1]] = segments[i]
+		} else if s != segments[i] {
+			return nil, false
+		}
+	}
+
+	return captures, len(segments) == len(route.segments)
+}
+
+func (route *mockRoute) serve(w http.ResponseWriter, r *http.Request, captures map[string]string) {
+	var buf bytes.Buffer
+
+	data := mockData{
+		Method:  r.Method,
+		Path:    captures,
+		Query:   make(map[string]string),
+		Headers: make(map[string]string),
+		Body:    mockRequestBody(r),
+	}
+
+	for k := range r.URL.Query() {
+		data.Query[k] = r.URL.Query().Get(k)
+	}
+
+	for k := range r.Header {
+		data.Headers[k] = r.Header.Get(k)
+	}
+
+	if err := route.body.Execute(&buf, data); err != nil {
+		http.Error(w, fmt.Sprintf("Mock %s failed: %s", route.source, err), http.StatusInternalServerError)
+		return
+	}
+
+	if route.delay > 0 {
+		select {
+		case <-time.After(route.delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	for k, v := range route.Headers {
+		w.Header().Set(k, v)
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		if len(route.JSON) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+		} else if ct := mime.TypeByExtension(filepath.Ext(route.File)); route.File != "" && ct != "" {
+			w.Header().Set("Content-Type", ct)
+		} else {
+			w.Header().Set("Content-Type", http.DetectContentType(buf.Bytes()))
+		}
+	}
+
+	w.WriteHeader(route.Status)
+	w.Write(buf.Bytes())
+}
+
+// mockRequestBody decodes json or form request bodies so their fields are available to templates
+func mockRequestBody(r *http.Request) interface{} {
+	var body interface{}
+
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediatype == "application/x-www-form-urlencoded" || mediatype == "multipart/form-data":
+		if err := r.ParseMultipartForm(10 << 20); err != nil && err != http.ErrNotMultipart {
+			return nil
+		}
+
+		fields := make(map[string]interface{})
+		for k := range r.PostForm {
+			fields[k] = r.PostForm.Get(k)
+		}
+		return fields
+	case r.Body != nil:
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, 10<<20))
+		if err != nil || len(data) == 0 {
+			return nil
+		}
+
+		if json.Unmarshal(data, &body) != nil {
+			return string(data)
+		}
+	}
+
+	return body
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	rateLimitKeyIP     = "ip"
+	rateLimitKeyHeader = "header"
+	rateLimitKeyGlobal = "global"
+)
+
+// RateLimit represents token bucket rate limiting options for a mapping
+type RateLimit struct {
+	Requests float64           `json:"requests"`
+	Period   string            `json:"period"`
+	Burst    int               `json:"burst"`
+	Key      string            `json:"key"`
+	Header   string            `json:"header"`
+	Status   int               `json:"status"`
+	Body     string            `json:"body"`
+	Headers  map[string]string `json:"headers"`
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	config RateLimit
+	rate   float64 // tokens per second
+	burst  float64
+	period time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	sweep   time.Time
+}
+
+func newRateLimiter(config RateLimit) (*rateLimiter, error) {
+	var (
+		err    error
+		period = time.Second
+	)
+
+	if config.Requests <= 0 {
+		return nil, fmt.Errorf("rate_limit requests must be greater than 0")
+	}
+
+	if config.Period != "" {
+		if period, err = time.ParseDuration(config.Period); err != nil {
+			return nil, fmt.Errorf("invalid rate_limit period %s: %s", config.Period, err)
+		} else if period <= 0 {
+			return nil, fmt.Errorf("rate_limit period must be greater than 0")
+		}
+	}
+
+	switch config.Key {
+	case "":
+		config.Key = rateLimitKeyIP
+	case rateLimitKeyIP, rateLimitKeyGlobal:
+	case rateLimitKeyHeader:
+		if config.Header == "" {
+			return nil, fmt.Errorf("rate_limit header must be set when key is %s", rateLimitKeyHeader)
+		}
+	default:
+		return nil, fmt.Errorf("invalid rate_limit key %s", config.Key)
+	}
+
+	if config.Burst <= 0 {
+		config.Burst = int(math.Ceil(config.Requests))
+	}
+
+	if config.Status == 0 {
+		config.Status = http.StatusTooManyRequests
+	} else if config.Status < 100 || config.Status > 999 {
+		return nil, fmt.Errorf("invalid rate_limit status %d", config.Status)
+	}
+
+	return &rateLimiter{
+		config:  config,
+		rate:    config.Requests / period.Seconds(),
+		burst:   float64(config.Burst),
+		period:  period,
+		buckets: make(map[string]*bucket),
+	}, nil
+}
+
+// allow consumes a token for the client of r; when none is left it writes the rejection and returns false
+func (l *rateLimiter) allow(w http.ResponseWriter, r *http.Request) bool {
+	if l == nil {
+		return true
+	}
+
+	ok, remaining, wait := l.take(l.key(r), time.Now())
+
+	reset := int(math.Ceil((l.burst - remaining) / l.rate))
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(int(l.burst)))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(remaining)))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(reset))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", int(l.burst), int(math.Ceil(l.period.Seconds()))))
+
+	if ok {
+		return true
+	}
+
+	for k, v := range l.config.Headers {
+		w.Header().Set(k, v)
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.WriteHeader(l.config.Status)
+
+	if l.config.Body == "" {
+		fmt.Fprintf(w, "Rate limit exceeded for prefix: %s", r.URL.Path)
+	} else {
+		fmt.Fprint(w, l.config.Body)
+	}
+
+	if !silent {
+		log.Printf("[rate limited] %s %s\n", clientIP(r), r.URL.Path)
+	}
+
+	return false
+}
+
+func (l *rateLimiter) key(r *http.Request) string {
+	switch l.config.Key {
+	case rateLimitKeyGlobal:
+		return ""
+	case rateLimitKeyHeader:
+		return r.Header.Get(l.config.Header)
+	default:
+		return clientIP(r)
+	}
+}
+
+func (l *rateLimiter) take(key string, now time.Time) (bool, float64, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.sweep) > time.Minute {
+		l.cleanup(now)
+	}
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, 0, wait
+	}
+
+	b.tokens--
+
+	return true, math.Floor(b.tokens), 0
+}
+
+// cleanup drops buckets which have been refilled completely
+func (l *rateLimiter) cleanup(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+
+	l.sweep = now
+}
+
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var defaultRewriteTypes = []string{
+	"text/html",
+	"text/css",
+	"text/xml",
+	"text/javascript",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// rewriteHeaders are response headers which may hold absolute urls of the destination
+var rewriteHeaders = []string{"Location", "Content-Location", "Refresh", "Link"}
+
+// Rewrite represents substitutions applied to response bodies of a mapping
+type Rewrite struct {
+	Types   []string      `json:"types"`
+	Rules   []RewriteRule `json:"rules"`
+	Origin  *bool         `json:"origin"`
+	MaxSize int           `json:"max_size"`
+}
+
+// RewriteRule represents a literal or regular expression substitution
+type RewriteRule struct {
+	Find    string `json:"find"`
+	Replace string `json:"replace"`
+	Regex   bool   `json:"regex"`
+}
+
+type rewriteRule struct {
+	find    []byte
+	regex   *regexp.Regexp
+	replace []byte
+}
+
+type rewriter struct {
+	types   []string
+	rules   []rewriteRule
+	origins []*url.URL
+	maxSize int
+}
+
+// newRewriter creates a rewriter; origins are the destinations of the mapping, replaced by the origin clients use
+func newRewriter(config Rewrite, origins []string) (*rewriter, error) {
+	rw := &rewriter{maxSize: config.MaxSize}
+
+	if rw.maxSize < 0 {
+		return nil, fmt.Errorf("rewrite max_size must not be negative")
+	} else if rw.maxSize == 0 {
+		rw.maxSize = 10 << 20
+	}
+
+	if len(config.Types) == 0 {
+		config.Types = defaultRewriteTypes
+	}
+
+	for _, t := range config.Types {
+		rw.types = append(rw.types, strings.ToLower(strings.TrimSpace(t)))
+	}
+
+	if config.Origin == nil || *config.Origin {
+		for _, o := range origins {
+			u, err := url.Parse(o)
+			if err != nil {
+				return nil, fmt.Errorf("invalid url %s: %s", o, err)
+			}
+			rw.origins = append(rw.origins, u)
+		}
+	}
+
+	for i, rule := range config.Rules {
+		if rule.Find == "" {
+			return nil, fmt.Errorf("rewrite rule find not found at element %d", i+1)
+		}
+
+		r := rewriteRule{replace: []byte(rule.Replace)}
+		if rule.Regex {
+			regex, err := regexp.Compile(rule.Find)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex %s: %s", rule.Find, err)
+			}
+			r.regex = regex
+		} else {
+			r.find = []byte(rule.Find)
+		}
+		rw.rules = append(rw.rules, r)
+	}
+
+	return rw, nil
+}
+
+// handler rewrites responses of next: urls of the destination are replaced by the public origin, then rules are applied
+func (rw *rewriter) handler(next http.Handler) http.Handler {
+	if rw == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// bodies must come back in an encoding which can be rewritten
+		if acceptsEncoding(r, "gzip") {
+			r.Header.Set("Accept-Encoding", "gzip")
+		} else {
+			r.Header.Del("Accept-Encoding")
+		}
+
+		ww := &rewriteResponseWriter{ResponseWriter: w, rw: rw, replacer: rw.replacer(publicOrigin(r)), head: r.Method == http.MethodHead}
+		next.ServeHTTP(ww, r)
+		ww.close()
+	})
+}
+
+// replacer returns the pairs of strings turning urls of the destination into urls of the public origin,
+// an origin is only replaced where it ends, see replaceOrigin
+func (rw *rewriter) replacer(public *url.URL) []string {
+	var pairs []string
+
+	for _, o := range rw.origins {
+		if o.Host == public.Host && o.Scheme == public.Scheme {
+			continue
+		}
+
+		from, to := o.Scheme+"://"+o.Host, public.Scheme+"://"+public.Host
+		pairs = append(pairs,
+			from, to,
+			strings.Replace(from, "/", `\/`, -1), strings.Replace(to, "/", `\/`, -1),
+		)
+	}
+
+	// protocol relative urls, once absolute ones are done
+	for _, o := range rw.origins {
+		if o.Host != public.Host {
+			pairs = append(pairs, "//"+o.Host, "//"+public.Host)
+		}
+	}
+
+	return pairs
+}
+
+func (rw *rewriter) apply(body []byte, pairs []string) []byte {
+	for i := 0; i < len(pairs); i += 2 {
+		body = replaceOrigin(body, []byte(pairs[i]), []byte(pairs[i+1]))
+	}
+
+	for _, rule := range rw.rules {
+		if rule.regex != nil {
+			body = rule.regex.ReplaceAll(body, rule.replace)
+		} else {
+			body = bytes.Replace(body, rule.find, rule.replace, -1)
+		}
+	}
+
+	return body
+}
+
+// replaceOrigin replaces from with to where from is not followed by a character of a host,
+// so that http://host:80 is left alone in http://host:8080 and http://host in http://host.example.com
+func replaceOrigin(body, from, to []byte) []byte {
+	var out []byte
+	last := 0
+
+	for i := 0; ; {
+		n := bytes.Index(body[i:], from)
+		if n < 0 {
+			break
+		}
+
+		start, end := i+n, i+n+len(from)
+		i = start + 1
+
+		if end < len(body) && isHostByte(body[end]) {
+			continue
+		}
+
+		out = append(out, body[last:start]...)
+		out = append(out, to...)
+		last, i = end, end
+	}
+
+	if out == nil {
+		return body
+	}
+
+	return append(out, body[last:]...)
+}
+
+// isHostByte reports whether c may be part of a host and port
+func isHostByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_' || c == ':'
+}
+
+// publicOrigin is the origin clients used to reach gorexy
+func publicOrigin(r *http.Request) *url.URL {
+	origin := &url.URL{Scheme: "http", Host: r.Host}
+
+	if r.TLS != nil {
+		origin.Scheme = "https"
+	}
+
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		origin.Scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+
+	if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+		origin.Host = strings.TrimSpace(strings.Split(host, ",")[0])
+	}
+
+	return origin
+}
+
+// rewriteResponseWriter holds back rewritable bodies until they are complete; others are passed through
+type rewriteResponseWriter struct {
+	http.ResponseWriter
+	rw        *rewriter
+	replacer  []string
+	head      bool
+	status    int
+	decided   bool
+	buffering bool
+	buf       bytes.Buffer
+}
+
+func (w *rewriteResponseWriter) WriteHeader(status int) {
+	if w.decided {
+		return
+	}
+
+	w.decided = true
+	w.status = status
+
+	h := w.Header()
+	for _, name := range rewriteHeaders {
+		for i, v := range h[name] {
+			h[name][i] = string(w.rw.apply([]byte(v), w.replacer))
+		}
+	}
+
+	encoding := h.Get("Content-Encoding")
+
+	switch {
+	case w.head, status < http.StatusOK, status == http.StatusNoContent, status == http.StatusNotModified:
+	case encoding != "" && encoding != "gzip":
+	case !matchesMediaType(w.rw.types, h.Get("Content-Type")):
+	default:
+		if n, err := strconv.Atoi(h.Get("Content-Length")); err != nil || n <= w.rw.maxSize {
+			w.buffering = true
+			return
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *rewriteResponseWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.buffering {
+		return w.ResponseWriter.Write(b)
+	}
+
+	if w.buf.Len()+len(b) > w.rw.maxSize {
+		// too big to be rewritten, what has been held back goes out untouched
+		w.buffering = false
+		w.ResponseWriter.WriteHeader(w.status)
+		if _, err := w.ResponseWriter.Write(w.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		w.buf.Reset()
+		return w.ResponseWriter.Write(b)
+	}
+
+	return w.buf.Write(b)
+}
+
+func (w *rewriteResponseWriter) Flush() {
+	if w.buffering {
+		return
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *rewriteResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *rewriteResponseWriter) close() {
+	if !w.buffering {
+		return
+	}
+
+	h := w.Header()
+	body := w.buf.Bytes()
+	gzipped := h.Get("Content-Encoding") == "gzip"
+
+	if gzipped {
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err == nil {
+			body, err = ioutil.ReadAll(gz)
+		}
+
+		if err != nil {
+			// not valid gzip after all, leave it as is
+			w.ResponseWriter.WriteHeader(w.status)
+			w.ResponseWriter.Write(w.buf.Bytes())
+			return
+		}
+	}
+
+	body = w.rw.apply(body, w.replacer)
+
+	if gzipped {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(body)
+		gz.Close()
+		body = buf.Bytes()
+	}
+
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Del("Accept-Ranges")
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
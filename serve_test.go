@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const (
+	h2Data     = 0x0
+	h2Headers  = 0x1
+	h2Settings = 0x4
+
+	h2EndHeaders = 0x4
+	h2Ack        = 0x1
+
+	// SETTINGS_ENABLE_CONNECT_PROTOCOL of RFC 8441
+	h2EnableConnect = 0x8
+)
+
+type h2Frame struct {
+	kind, flags byte
+	stream      uint32
+	payload     []byte
+}
+
+func writeH2Frame(w io.Writer, kind, flags byte, stream uint32, payload []byte) error {
+	header := make([]byte, 9, 9+len(payload))
+	binary.BigEndian.PutUint32(header, uint32(len(payload))<<8|uint32(kind))
+	header[4] = flags
+	binary.BigEndian.PutUint32(header[5:], stream)
+
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+func readH2Frame(r io.Reader) (h2Frame, error) {
+	var header [9]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return h2Frame{}, err
+	}
+
+	f := h2Frame{
+		kind:    header[3],
+		flags:   header[4],
+		stream:  binary.BigEndian.Uint32(header[5:]) & 0x7fffffff,
+		payload: make([]byte, int(header[0])<<16|int(header[1])<<8|int(header[2])),
+	}
+	_, err := io.ReadFull(r, f.payload)
+
+	return f, err
+}
+
+// hpackLiteral encodes a header field as a literal without indexing and without huffman coding
+func hpackLiteral(name, value string) []byte {
+	b := []byte{0, byte(len(name))}
+	b = append(b, name...)
+	b = append(b, byte(len(value)))
+	return append(b, value...)
+}
+
+// a websocket is opened over HTTP/2 with an extended CONNECT on a server set up like those of serve
+func TestExtendedConnect(t *testing.T) {
+	var err error
+	if throttling, err = newThrottler(Throttle{}); err != nil {
+		t.Fatal(err)
+	}
+
+	htprox, wsprox, err := createProxies([]Mapping{{
+		Path:        "/socket",
+		Destination: "ws-mock://socket",
+		WSMock:      &WSMock{OnConnect: []WSMockMessage{{Text: "hello"}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies.set(htprox, wsprox)
+	defer proxies.set(nil, nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newServer("")
+	server.Handler = http.HandlerFunc(forwarder)
+	go server.Serve(l)
+	defer server.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c)
+
+	io.WriteString(c, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	writeH2Frame(c, h2Settings, 0, 0, nil)
+
+	var settings h2Frame
+	for settings.kind != h2Settings || settings.flags&h2Ack != 0 {
+		if settings, err = readH2Frame(br); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	advertised := false
+	for p := settings.payload; len(p) >= 6; p = p[6:] {
+		if binary.BigEndian.Uint16(p) == h2EnableConnect && binary.BigEndian.Uint32(p[2:]) == 1 {
+			advertised = true
+		}
+	}
+	if !advertised {
+		t.Fatalf("extended CONNECT is not advertised in %x", settings.payload)
+	}
+	writeH2Frame(c, h2Settings, h2Ack, 0, nil)
+
+	var block []byte
+	for _, field := range [][2]string{
+		{":method", "CONNECT"},
+		{":protocol", "websocket"},
+		{":scheme", "http"},
+		{":path", "/socket"},
+		{":authority", "localhost"},
+		{"sec-websocket-version", "13"},
+	} {
+		block = append(block, hpackLiteral(field[0], field[1])...)
+	}
+	writeH2Frame(c, h2Headers, h2EndHeaders, 1, block)
+
+	for {
+		f, err := readH2Frame(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if f.stream != 1 {
+			continue
+		}
+
+		switch f.kind {
+		case h2Headers:
+			// 0x88 is the indexed field :status 200
+			if len(f.payload) == 0 || f.payload[0] != 0x88 {
+				t.Fatalf("expected status 200, got headers %x", f.payload)
+			}
+		case h2Data:
+			if want := "\x81\x05hello"; string(f.payload) != want {
+				t.Fatalf("expected the frame %q, got %q", want, f.payload)
+			}
+			return
+		default:
+			t.Fatalf("unexpected frame of type %d on the stream: %x", f.kind, f.payload)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fluxynet/gorexy/wsutils"
+)
+
+const (
+	websocketsPath = adminPath + "/websockets"
+
+	// close codes of RFC 6455
+	closeGoingAway      = 1001
+	closeServiceRestart = 1012
+)
+
+// WSSession is a live websocket or upgraded connection as listed by the admin endpoint
+type WSSession struct {
+	ID        int64     `json:"id"`
+	Mapping   string    `json:"mapping"`
+	Path      string    `json:"path"`
+	Protocol  string    `json:"protocol"`
+	Client    string    `json:"client"`
+	Upstream  string    `json:"upstream"`
+	Started   time.Time `json:"started"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+}
+
+// liveSession is a connection which may be listed, written to and closed through the admin endpoint
+type liveSession interface {
+	BytesUp() int64
+	BytesDown() int64
+	Send(binary bool, payload []byte) error
+	Close(code int, reason string)
+}
+
+type trackedSession struct {
+	id       int64
+	mapping  string
+	request  *http.Request
+	upstream string
+	start    time.Time
+	liveSession
+}
+
+// sessionRegistry keeps the live connections of all websocket mappings
+type sessionRegistry struct {
+	mu       sync.Mutex
+	last     int64
+	sessions map[liveSession]*trackedSession
+}
+
+var sessions = &sessionRegistry{sessions: make(map[liveSession]*trackedSession)}
+
+// open registers a connection established by r; it must be passed to closed when it ends
+func (reg *sessionRegistry) open(mapping string, r *http.Request, upstream string, s liveSession) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.last++
+	reg.sessions[s] = &trackedSession{id: reg.last, mapping: mapping, request: r, upstream: upstream, start: time.Now(), liveSession: s}
+}
+
+func (reg *sessionRegistry) closed(s liveSession) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	delete(reg.sessions, s)
+}
+
+// track returns the function registering the connections of the websocket proxy of a mapping
+func (reg *sessionRegistry) track(mapping string) func(s *wsutils.Session, open bool) {
+	return func(s *wsutils.Session, open bool) {
+		if open {
+			reg.open(mapping, s.Request, s.Upstream, s)
+		} else {
+			reg.closed(s)
+		}
+	}
+}
+
+// find returns the sessions matching mapping and id, empty values matching all, in the order they were opened
+func (reg *sessionRegistry) find(mapping string, id int64) []*trackedSession {
+	var list []*trackedSession
+
+	reg.mu.Lock()
+	for _, s := range reg.sessions {
+		if (mapping == "" || s.mapping == mapping) && (id == 0 || s.id == id) {
+			list = append(list, s)
+		}
+	}
+	reg.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+
+	return list
+}
+
+// closeService closes the sessions connected to service, before it restarts: those whose upstream is a local port of
+// the service, either allocated by gorexy or the destination of a mapping, or the destination of a mapping reloaded with it
+func (reg *sessionRegistry) closeService(service Service) {
+	known := make(map[string]bool)
+	for _, port := range ports {
+		known[port] = true
+	}
+
+	local := make(map[string]bool)
+	htprox, wsprox := proxies.get()
+
+	for _, p := range htprox {
+		if port := localPort(p.Destination); port != "" {
+			known[port] = true
+			if p.LiveReload != nil && p.LiveReload.service == service.Name {
+				local[port] = true
+			}
+		}
+	}
+
+	for _, p := range wsprox {
+		if port := localPort(p.Destination); port != "" {
+			known[port] = true
+		}
+	}
+
+	// the ports of a started service have already been substituted in its arguments
+	for _, field := range strings.FieldsFunc(parsePorts(service.Args+" "+service.Env), func(r rune) bool { return r < '0' || r > '9' }) {
+		if known[field] {
+			local[field] = true
+		}
+	}
+
+	closed := 0
+	for _, s := range reg.find("", 0) {
+		host, port, err := net.SplitHostPort(s.upstream)
+		if err != nil || !local[port] || !isLocalHost(host) {
+			continue
+		}
+
+		s.Close(closeServiceRestart, "Service restart")
+		closed++
+	}
+
+	if closed > 0 {
+		log.Printf("[websockets closed] %s: %d\n", service.Name, closed)
+	}
+}
+
+// localPort returns the port of destination when it is on this machine
+func localPort(destination *url.URL) string {
+	if destination == nil || !isLocalHost(destination.Hostname()) {
+		return ""
+	}
+
+	return destination.Port()
+}
+
+func isLocalHost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+func (s *trackedSession) info() WSSession {
+	return WSSession{
+		ID:        s.id,
+		Mapping:   s.mapping,
+		Path:      s.request.URL.Path,
+		Protocol:  wsutils.Upgrade(s.request),
+		Client:    s.request.RemoteAddr,
+		Upstream:  s.upstream,
+		Started:   s.start,
+		BytesUp:   s.BytesUp(),
+		BytesDown: s.BytesDown(),
+	}
+}
+
+// websocketsHandler lists live sessions; POST sends its body to the clients of, and DELETE closes, one session, those of a mapping or all of them
+func websocketsHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		id      int64
+		err     error
+		mapping = r.URL.Query().Get("mapping")
+	)
+
+	if v := r.URL.Query().Get("id"); v != "" {
+		if id, err = strconv.ParseInt(v, 10, 64); err != nil || id <= 0 {
+			http.Error(w, "Invalid id "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	list := sessions.find(mapping, id)
+
+	switch r.Method {
+	case http.MethodGet:
+		infos := []WSSession{}
+		for _, s := range list {
+			infos = append(infos, s.info())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+	case http.MethodDelete:
+		if id != 0 && len(list) == 0 {
+			http.Error(w, fmt.Sprintf("No websocket found with id %d", id), http.StatusNotFound)
+			return
+		}
+
+		for _, s := range list {
+			s.Close(closeGoingAway, "Closed by gorexy")
+		}
+
+		log.Printf("[websockets closed] mapping=%q id=%d: %d\n", mapping, id, len(list))
+		fmt.Fprintf(w, "Closed %d websocket(s)\n", len(list))
+	case http.MethodPost:
+		if id != 0 && len(list) == 0 {
+			http.Error(w, fmt.Sprintf("No websocket found with id %d", id), http.StatusNotFound)
+			return
+		}
+
+		message, err := ioutil.ReadAll(io.LimitReader(r.Body, 10<<20))
+		if err != nil {
+			http.Error(w, "Failed to read message: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		binary := r.URL.Query().Get("type") == "binary"
+		if !binary && !utf8.Valid(message) {
+			http.Error(w, "Text messages must be valid utf-8, use type=binary", http.StatusBadRequest)
+			return
+		}
+
+		sent := 0
+		for _, s := range list {
+			if err := s.Send(binary, message); err != nil {
+				log.Printf("[websocket send failed] %d: %s\n", s.id, err)
+				continue
+			}
+			sent++
+		}
+
+		if sent < len(list) {
+			w.WriteHeader(http.StatusConflict)
+		}
+		fmt.Fprintf(w, "Sent to %d of %d websocket(s)\n", sent, len(list))
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	shadowPath     = adminPath + "/shadow"
+	shadowMaxDiffs = 100
+	shadowMaxLines = 20
+
+	// bytes of each body shown from where non json bodies differ
+	shadowExcerpt = 32
+)
+
+var arrayIndexRegex = regexp.MustCompile(`\[[0-9]+\]`)
+
+// Shadow represents a shadow destination receiving a copy of the requests of a mapping
+type Shadow struct {
+	Destination    string   `json:"destination"`
+	CompareHeaders []string `json:"compare_headers"`
+	IgnoreFields   []string `json:"ignore_fields"`
+	MaxBodySize    int      `json:"max_body_size"`
+	Timeout        string   `json:"timeout"`
+}
+
+// ShadowDiff represents the differences between a primary and a shadow response
+type ShadowDiff struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	URL         string    `json:"url"`
+	Differences []string  `json:"differences"`
+}
+
+type shadowResponse struct {
+	status int
+	header http.Header
+	body   cappedBuffer
+	err    error
+}
+
+type shadowMirror struct {
+	proxy   *httputil.ReverseProxy
+	headers []string
+	ignore  map[string]bool
+	maxBody int
+	timeout time.Duration
+
+	mu       sync.Mutex
+	compared int
+	matched  int
+	diffs    []ShadowDiff
+}
+
+func newShadowMirror(config Shadow) (*shadowMirror, error) {
+	var err error
+
+	if config.Destination == "" {
+		return nil, fmt.Errorf("shadow destination must not be empty")
+	}
+
+	target, err := url.Parse(parsePorts(config.Destination))
+	if err != nil {
+		return nil, fmt.Errorf("invalid shadow url %s: %s", config.Destination, err)
+	} else if target.Scheme != httpMapping {
+		return nil, fmt.Errorf("shadow destination must be an http url")
+	}
+
+	m := &shadowMirror{
+		proxy:   httputil.NewSingleHostReverseProxy(target),
+		ignore:  make(map[string]bool),
+		maxBody: config.MaxBodySize,
+		timeout: 30 * time.Second,
+	}
+
+	m.proxy.ErrorLog = log.New(ioutil.Discard, "", 0)
+	m.proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		w.(*shadowResponseWriter).res.err = err
+	}
+
+	if m.maxBody <= 0 {
+		m.maxBody = 1 << 20
+	}
+
+	if config.Timeout != "" {
+		if m.timeout, err = time.ParseDuration(config.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid shadow timeout %s: %s", config.Timeout, err)
+		}
+	}
+
+	for _, h := range config.CompareHeaders {
+		m.headers = append(m.headers, http.CanonicalHeaderKey(h))
+	}
+
+	for _, f := range config.IgnoreFields {
+		m.ignore[f] = true
+	}
+
+	return m, nil
+}
+
+// handler sends a copy of each request to the shadow destination and compares its response with the one of next
+func (m *shadowMirror) handler(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+
+		if r.Body != nil && r.Body != http.NoBody {
+			data, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(m.maxBody)+1))
+			if err != nil || len(data) > m.maxBody {
+				// too big to be mirrored, the primary request still gets the whole body
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body = data
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), m.timeout)
+		sreq := r.Clone(ctx)
+		sreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		shadow := make(chan *shadowResponse, 1)
+		go func() {
+			defer cancel()
+			sw := &shadowResponseWriter{res: &shadowResponse{header: make(http.Header), body: cappedBuffer{max: m.maxBody}}}
+			m.proxy.ServeHTTP(sw, sreq)
+			shadow <- sw.res
+		}()
+
+		pw := &shadowResponseWriter{ResponseWriter: w, res: &shadowResponse{body: cappedBuffer{max: m.maxBody}}}
+		next.ServeHTTP(pw, r)
+		pw.res.header = w.Header().Clone()
+
+		// the client must not wait for the shadow
+		method, uri, res := r.Method, r.URL.RequestURI(), pw.res
+		go func() {
+			m.compare(method, uri, res, <-shadow)
+		}()
+	})
+}
+
+func (m *shadowMirror) compare(method, url string, primary, shadow *shadowResponse) {
+	var differences []string
+
+	if shadow.err != nil {
+		differences = append(differences, fmt.Sprintf("shadow failed: %s", shadow.err))
+	} else {
+		if primary.status != shadow.status {
+			differences = append(differences, fmt.Sprintf("status: %d != %d", primary.status, shadow.status))
+		}
+
+		for _, h := range m.headers {
+			if p, s := strings.Join(primary.header[h], ", "), strings.Join(shadow.header[h], ", "); p != s {
+				differences = append(differences, fmt.Sprintf("header %s: %q != %q", h, p, s))
+			}
+		}
+
+		differences = append(differences, m.compareBodies(primary, shadow)...)
+	}
+
+	if len(differences) > shadowMaxLines {
+		differences = append(differences[:shadowMaxLines], fmt.Sprintf("and %d more", len(differences)-shadowMaxLines))
+	}
+
+	m.mu.Lock()
+	m.compared++
+	if len(differences) == 0 {
+		m.matched++
+	} else {
+		m.diffs = append(m.diffs, ShadowDiff{Time: time.Now(), Method: method, URL: url, Differences: differences})
+		if len(m.diffs) > shadowMaxDiffs {
+			m.diffs = m.diffs[len(m.diffs)-shadowMaxDiffs:]
+		}
+	}
+	m.mu.Unlock()
+
+	if len(differences) > 0 {
+		log.Printf("[shadow diff] %s %s: %s\n", method, url, strings.Join(differences, "; "))
+	}
+}
+
+func (m *shadowMirror) compareBodies(primary, shadow *shadowResponse) []string {
+	var (
+		pjson, sjson interface{}
+		differences  []string
+	)
+
+	if primary.body.truncated || shadow.body.truncated {
+		return nil
+	}
+
+	pbody := decodedBody(primary.header, primary.body.buf.Bytes())
+	sbody := decodedBody(shadow.header, shadow.body.buf.Bytes())
+
+	if json.Unmarshal(pbody, &pjson) != nil || json.Unmarshal(sbody, &sjson) != nil {
+		if !bytes.Equal(pbody, sbody) {
+			at := 0
+			for at < len(pbody) && at < len(sbody) && pbody[at] == sbody[at] {
+				at++
+			}
+
+			differences = append(differences, fmt.Sprintf("body at byte %d: %q != %q (%d bytes, %d bytes)", at, excerpt(pbody, at), excerpt(sbody, at), len(pbody), len(sbody)))
+		}
+		return differences
+	}
+
+	m.diffJSON("$", pjson, sjson, &differences)
+
+	return differences
+}
+
+// excerpt returns the bytes of body following offset, up to shadowExcerpt of them
+func excerpt(body []byte, offset int) string {
+	body = body[offset:]
+	if len(body) > shadowExcerpt {
+		return string(body[:shadowExcerpt]) + "..."
+	}
+
+	return string(body)
+}
+
+// diffJSON lists the paths where a and b differ, skipping ignored fields
+func (m *shadowMirror) diffJSON(path string, a, b interface{}, differences *[]string) {
+	if m.ignored(path) {
+		return
+	}
+
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := make(map[string]bool)
+		for k := range av {
+			keys[k] = true
+		}
+		for k := range bv {
+			keys[k] = true
+		}
+
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+
+		for _, k := range sorted {
+			m.diffJSON(path+"."+k, av[k], bv[k], differences)
+		}
+		return
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+
+		if len(av) != len(bv) {
+			*differences = append(*differences, fmt.Sprintf("%s: %d items != %d items", path, len(av), len(bv)))
+			return
+		}
+
+		for i := range av {
+			m.diffJSON(fmt.Sprintf("%s[%d]", path, i), av[i], bv[i], differences)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		pj, _ := json.Marshal(a)
+		sj, _ := json.Marshal(b)
+		*differences = append(*differences, fmt.Sprintf("%s: %s != %s", path, pj, sj))
+	}
+}
+
+// ignored matches a path against ignored fields, either a bare field name or a path such as items[].id
+func (m *shadowMirror) ignored(path string) bool {
+	if path == "$" {
+		return false
+	}
+
+	normalized := strings.TrimPrefix(arrayIndexRegex.ReplaceAllString(path, "[]"), "$.")
+	name := normalized[strings.LastIndexAny(normalized, ".]")+1:]
+
+	return m.ignore[normalized] || m.ignore[name]
+}
+
+func decodedBody(h http.Header, body []byte) []byte {
+	if !strings.EqualFold(h.Get("Content-Encoding"), "gzip") {
+		return body
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return body
+	}
+
+	decoded, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return body
+	}
+
+	return decoded
+}
+
+// shadowResponseWriter captures a response; without an underlying ResponseWriter the response is discarded
+type shadowResponseWriter struct {
+	http.ResponseWriter
+	res         *shadowResponse
+	wroteHeader bool
+}
+
+func (w *shadowResponseWriter) Header() http.Header {
+	if w.ResponseWriter == nil {
+		return w.res.header
+	}
+
+	return w.ResponseWriter.Header()
+}
+
+func (w *shadowResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+	w.res.status = status
+
+	if w.ResponseWriter != nil {
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *shadowResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	w.res.body.Write(b)
+
+	if w.ResponseWriter == nil {
+		return len(b), nil
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *shadowResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// shadowHandler lists the comparison results of shadowed mappings; DELETE clears them
+func shadowHandler(w http.ResponseWriter, r *http.Request) {
+	type mappingShadow struct {
+		Mapping  string       `json:"mapping"`
+		Compared int          `json:"compared"`
+		Matched  int          `json:"matched"`
+		Diffs    []ShadowDiff `json:"diffs"`
+	}
+
+	var (
+		list    = []mappingShadow{}
+		mapping = r.URL.Query().Get("mapping")
+	)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	htprox, _ := proxies.get()
+	for _, s := range htprox {
+		if s.Shadow == nil || (mapping != "" && mapping != s.Prefix) {
+			continue
+		}
+
+		s.Shadow.mu.Lock()
+		if r.Method == http.MethodDelete {
+			s.Shadow.compared, s.Shadow.matched, s.Shadow.diffs = 0, 0, nil
+		}
+		list = append(list, mappingShadow{
+			Mapping:  s.Prefix,
+			Compared: s.Shadow.compared,
+			Matched:  s.Shadow.matched,
+			Diffs:    append([]ShadowDiff{}, s.Shadow.diffs...),
+		})
+		s.Shadow.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
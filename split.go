@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/fluxynet/gorexy/wsutils"
+)
+
+const splitVariantHeader = "X-Gorexy-Variant"
+
+// Split represents weighted traffic splitting between several destinations of a mapping
+type Split struct {
+	Destinations []SplitDestination `json:"destinations"`
+	Header       string             `json:"header"`
+	Cookie       string             `json:"cookie"`
+	Override     string             `json:"override"`
+}
+
+// SplitDestination represents one variant of a split mapping
+type SplitDestination struct {
+	Name        string `json:"name"`
+	Destination string `json:"destination"`
+	Weight      int    `json:"weight"`
+}
+
+type splitVariant struct {
+	name    string
+	weight  int
+	proxy   *httputil.ReverseProxy
+	upgrade *wsutils.ReverseProxy
+}
+
+type splitter struct {
+	variants []splitVariant
+	total    int
+	header   string
+	cookie   string
+	override string
+	path     string
+}
+
+func newSplitter(config Split, mapping Mapping) (*splitter, error) {
+	s := &splitter{
+		header:   config.Header,
+		cookie:   config.Cookie,
+		override: config.Override,
+		path:     mapping.Path,
+	}
+
+	if s.cookie == "" {
+		s.cookie = "gorexy_split"
+	}
+
+	if s.override == "" {
+		s.override = "gorexy_variant"
+	}
+
+	if len(config.Destinations) == 0 {
+		return nil, fmt.Errorf("split destinations must not be empty")
+	}
+
+	for i, d := range config.Destinations {
+		if d.Name == "" {
+			return nil, fmt.Errorf("split destination name not found at element %d", i+1)
+		}
+
+		if s.variant(d.Name) != nil {
+			return nil, fmt.Errorf("duplicate split destination %s", d.Name)
+		}
+
+		if d.Weight < 0 {
+			return nil, fmt.Errorf("invalid weight %d for split destination %s", d.Weight, d.Name)
+		}
+
+		target, err := url.Parse(parsePorts(d.Destination))
+		if err != nil {
+			return nil, fmt.Errorf("invalid url %s: %s", d.Destination, err)
+		} else if target.Scheme != httpMapping {
+			return nil, fmt.Errorf("split destination %s must be an http url", d.Name)
+		}
+
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		if err = configureStreaming(proxy, mapping); err != nil {
+			return nil, err
+		}
+
+		if cookies := newCookieRewriter(mapping); cookies != nil {
+			proxy.ModifyResponse = cookies.modifyResponse
+		}
+
+		upgrade, err := newUpgradeProxy(target, mapping)
+		if err != nil {
+			return nil, err
+		}
+
+		s.variants = append(s.variants, splitVariant{name: d.Name, weight: d.Weight, proxy: proxy, upgrade: upgrade})
+		s.total += d.Weight
+	}
+
+	if s.total == 0 {
+		return nil, fmt.Errorf("split weights must not all be zero")
+	}
+
+	return s, nil
+}
+
+func (s *splitter) variant(name string) *splitVariant {
+	for i := range s.variants {
+		if s.variants[i].name == name {
+			return &s.variants[i]
+		}
+	}
+
+	return nil
+}
+
+// pick returns the variant at n, n being in [0, total)
+func (s *splitter) pick(n int) *splitVariant {
+	for i := range s.variants {
+		if n < s.variants[i].weight {
+			return &s.variants[i]
+		}
+		n -= s.variants[i].weight
+	}
+
+	return &s.variants[len(s.variants)-1]
+}
+
+// ServeHTTP forwards r to a variant: an override wins, then the sticky header, then the sticky cookie; new clients get a weighted random variant
+func (s *splitter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var v *splitVariant
+
+	if query := r.URL.Query(); query.Has(s.override) {
+		name := query.Get(s.override)
+		query.Del(s.override)
+		r.URL.RawQuery = query.Encode()
+
+		if v = s.variant(name); v != nil {
+			http.SetCookie(w, &http.Cookie{Name: s.override, Value: v.name, Path: s.path})
+		} else {
+			// an unknown or empty variant removes the override
+			http.SetCookie(w, &http.Cookie{Name: s.override, Path: s.path, MaxAge: -1})
+		}
+	} else if c, err := r.Cookie(s.override); err == nil {
+		v = s.variant(c.Value)
+	}
+
+	if v == nil && s.header != "" {
+		if value := r.Header.Get(s.header); value != "" {
+			h := fnv.New32a()
+			h.Write([]byte(value))
+			v = s.pick(int(h.Sum32() % uint32(s.total)))
+		}
+	}
+
+	if v == nil {
+		if c, err := r.Cookie(s.cookie); err == nil {
+			if v = s.variant(c.Value); v != nil && v.weight == 0 {
+				// variants taken out of rotation only keep their overridden clients
+				v = nil
+			}
+		}
+
+		if v == nil {
+			v = s.pick(rand.Intn(s.total))
+			http.SetCookie(w, &http.Cookie{Name: s.cookie, Value: v.name, Path: s.path, HttpOnly: true})
+		}
+	}
+
+	w.Header().Set(splitVariantHeader, v.name)
+
+	if wsutils.Upgrade(r) != "" {
+		v.upgrade.ServeHTTP(w, r)
+		return
+	}
+
+	v.proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/fluxynet/gorexy/wsutils"
+)
+
+const (
+	flushImmediate = "immediate"
+
+	serverReadHeaderTimeout = 30 * time.Second
+	serverIdleTimeout       = 2 * time.Minute
+)
+
+// timeouts represents the connection timeouts of a mapping
+type timeouts struct {
+	dial      time.Duration
+	response  time.Duration
+	idle      time.Duration
+	keepalive time.Duration
+}
+
+func parseTimeouts(mapping Mapping) (timeouts, error) {
+	var (
+		t   timeouts
+		err error
+	)
+
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"dial_timeout", mapping.DialTimeout, &t.dial},
+		{"timeout", mapping.Timeout, &t.response},
+		{"idle_timeout", mapping.IdleTimeout, &t.idle},
+		{"keepalive", mapping.KeepAlive, &t.keepalive},
+	} {
+		if d.value == "" {
+			continue
+		}
+
+		if *d.dst, err = time.ParseDuration(d.value); err != nil {
+			return t, fmt.Errorf("invalid %s %s: %s", d.name, d.value, err)
+		}
+	}
+
+	return t, nil
+}
+
+// configureStreaming applies the flush and timeout options of a mapping to its proxy
+func configureStreaming(proxy *httputil.ReverseProxy, mapping Mapping) error {
+	var err error
+
+	switch mapping.FlushInterval {
+	case "":
+	case flushImmediate:
+		proxy.FlushInterval = -1
+	default:
+		if proxy.FlushInterval, err = time.ParseDuration(mapping.FlushInterval); err != nil {
+			return fmt.Errorf("invalid flush_interval %s: %s", mapping.FlushInterval, err)
+		}
+	}
+
+	timeouts, err := parseTimeouts(mapping)
+	if err != nil {
+		return err
+	}
+
+	if timeouts.response > 0 || timeouts.dial > 0 {
+		t, ok := proxy.Transport.(*http.Transport)
+		if !ok || t == nil {
+			t = http.DefaultTransport.(*http.Transport)
+		}
+
+		t = t.Clone()
+		t.ResponseHeaderTimeout = timeouts.response
+		if timeouts.dial > 0 {
+			t.DialContext = (&net.Dialer{Timeout: timeouts.dial, KeepAlive: 30 * time.Second}).DialContext
+		}
+		proxy.Transport = t
+	}
+
+	if timeouts.idle > 0 {
+		proxy.Transport = &idleTimeoutTransport{RoundTripper: proxy.Transport, timeout: timeouts.idle}
+	}
+
+	next := proxy.ErrorHandler
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		// the client went away; the upstream request has been cancelled and nobody is left to answer
+		if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+			if !silent {
+				log.Printf("[client disconnected] %s %s\n", r.Method, r.URL.Path)
+			}
+			return
+		}
+
+		if next != nil {
+			next(w, r, err)
+			return
+		}
+
+		log.Printf("[upstream error] %s %s: %s\n", r.Method, r.URL.Path, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	return nil
+}
+
+// newUpgradeProxy creates a proxy for websockets and other upgraded connections to target
+func newUpgradeProxy(target *url.URL, mapping Mapping) (*wsutils.ReverseProxy, error) {
+	proxy := wsutils.NewReverseProxy(target)
+	proxy.Wrap = throttleStreams
+	proxy.Track = sessions.track(mapping.Path)
+
+	if mapping.Inspect && inspection != nil {
+		proxy.Inspect = inspection.inspect(mapping.Path)
+	}
+
+	return proxy, configureWebsocket(proxy, mapping)
+}
+
+// configureWebsocket applies the timeout and keepalive options of a mapping to its websocket proxy
+func configureWebsocket(proxy *wsutils.ReverseProxy, mapping Mapping) error {
+	timeouts, err := parseTimeouts(mapping)
+	if err != nil {
+		return err
+	}
+
+	if timeouts.dial > 0 {
+		proxy.DialTimeout = timeouts.dial
+	}
+
+	if timeouts.response > 0 {
+		proxy.HandshakeTimeout = timeouts.response
+	}
+
+	proxy.IdleTimeout = timeouts.idle
+	proxy.KeepAlive = timeouts.keepalive
+
+	return nil
+}
+
+// idleTimeoutTransport closes response bodies which stay silent for longer than timeout
+type idleTimeoutTransport struct {
+	http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *idleTimeoutTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rt := t.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	res, err := rt.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	body := &idleTimeoutBody{ReadCloser: res.Body, timeout: t.timeout, path: r.URL.Path}
+	body.timer = time.AfterFunc(t.timeout, body.expire)
+	res.Body = body
+
+	return res, nil
+}
+
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	path    string
+	timer   *time.Timer
+	once    sync.Once
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+
+	return n, err
+}
+
+func (b *idleTimeoutBody) expire() {
+	log.Printf("[idle timeout] %s after %s\n", b.path, b.timeout)
+	b.Close()
+}
+
+func (b *idleTimeoutBody) Close() error {
+	var err error
+
+	b.timer.Stop()
+	b.once.Do(func() { err = b.ReadCloser.Close() })
+
+	return err
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	streamsPath = adminPath + "/streams"
+	tcpStream   = "tcp"
+	udpStream   = "udp"
+)
+
+// Stream represents raw tcp or udp forwarding from a local address to an upstream address
+type Stream struct {
+	Name        string `json:"name"`
+	Protocol    string `json:"protocol"`
+	Listen      string `json:"listen"`
+	Upstream    string `json:"upstream"`
+	TLS         bool   `json:"tls"`
+	Cert        string `json:"cert"`
+	Key         string `json:"key"`
+	IdleTimeout string `json:"idle_timeout"`
+}
+
+// StreamStats represents the counters of a stream
+type StreamStats struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Listen   string `json:"listen"`
+	Upstream string `json:"upstream"`
+	Active   int64  `json:"active"`
+	Total    int64  `json:"total"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+	Errors   int64  `json:"errors"`
+	TLS      bool   `json:"tls"`
+}
+
+type streamProxy struct {
+	config  Stream
+	idle    time.Duration
+	tls     *tls.Config
+	active  int64
+	total   int64
+	in      int64 // bytes from clients to upstream
+	out     int64 // bytes from upstream to clients
+	errored int64
+}
+
+var streams []*streamProxy
+
+// startStreams validates streams and starts listening on each of them
+func startStreams(configs []Stream, cert, key string) ([]*streamProxy, error) {
+	var list []*streamProxy
+
+	for i, config := range configs {
+		var err error
+
+		if config.Name == "" {
+			config.Name = fmt.Sprintf("stream%d", i+1)
+		}
+
+		if config.Protocol == "" {
+			config.Protocol = tcpStream
+		}
+
+		if config.Listen == "" || config.Upstream == "" {
+			return nil, fmt.Errorf("listen and upstream are required for stream %s", config.Name)
+		}
+
+		config.Listen = parsePorts(config.Listen)
+		config.Upstream = parsePorts(config.Upstream)
+
+		s := &streamProxy{config: config}
+
+		if config.IdleTimeout != "" {
+			if s.idle, err = time.ParseDuration(config.IdleTimeout); err != nil {
+				return nil, fmt.Errorf("invalid idle_timeout for stream %s: %s", config.Name, err)
+			} else if s.idle < 0 || (s.idle == 0 && config.Protocol == udpStream) {
+				// udp sessions only end when they are idle
+				return nil, fmt.Errorf("invalid idle_timeout for stream %s: %s", config.Name, config.IdleTimeout)
+			}
+		} else if config.Protocol == udpStream {
+			s.idle = time.Minute
+		}
+
+		if config.TLS {
+			if config.Protocol != tcpStream {
+				return nil, fmt.Errorf("tls is only supported on tcp streams for stream %s", config.Name)
+			}
+
+			if config.Cert == "" && config.Key == "" {
+				config.Cert, config.Key = cert, key
+			}
+
+			pair, err := tls.LoadX509KeyPair(normalizePath(config.Cert, true), normalizePath(config.Key, true))
+			if err != nil {
+				return nil, fmt.Errorf("invalid tls for stream %s: %s", config.Name, err)
+			}
+			s.tls = &tls.Config{Certificates: []tls.Certificate{pair}}
+		}
+
+		switch config.Protocol {
+		case tcpStream:
+			err = s.listenTCP()
+		case udpStream:
+			err = s.listenUDP()
+		default:
+			err = fmt.Errorf("unknown protocol %s", config.Protocol)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid stream %s: %s", config.Name, err)
+		}
+
+		scheme := config.Protocol
+		if s.tls != nil {
+			scheme += "+tls"
+		}
+		log.Printf("[stream] %s listening on %s://%s -> %s\n", config.Name, scheme, config.Listen, config.Upstream)
+
+		list = append(list, s)
+	}
+
+	return list, nil
+}
+
+func (s *streamProxy) listenTCP() error {
+	var (
+		l   net.Listener
+		err error
+	)
+
+	if s.tls != nil {
+		l, err = tls.Listen("tcp", s.config.Listen, s.tls)
+	} else {
+		l, err = net.Listen("tcp", s.config.Listen)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				log.Printf("[stream] %s stopped accepting: %s\n", s.config.Name, err)
+				return
+			}
+			go s.serveTCP(c)
+		}
+	}()
+
+	return nil
+}
+
+func (s *streamProxy) serveTCP(c net.Conn) {
+	var (
+		start  = time.Now()
+		client = c.RemoteAddr().String()
+		wg     sync.WaitGroup
+		in     int64
+		out    int64
+		last   = time.Now().UnixNano()
+	)
+
+	defer c.Close()
+
+	atomic.AddInt64(&s.total, 1)
+	atomic.AddInt64(&s.active, 1)
+	defer atomic.AddInt64(&s.active, -1)
+
+	u, err := net.DialTimeout("tcp", s.config.Upstream, 10*time.Second)
+	if err != nil {
+		atomic.AddInt64(&s.errored, 1)
+		log.Printf("[stream] %s %s: upstream unreachable: %s\n", s.config.Name, client, err)
+		return
+	}
+	defer u.Close()
+
+	if !silent {
+		log.Printf("[stream] %s %s connected\n", s.config.Name, client)
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		in = s.copy(u, c, &s.in, &last)
+		closeWrite(u)
+	}()
+	go func() {
+		defer wg.Done()
+		out = s.copy(c, u, &s.out, &last)
+		closeWrite(c)
+	}()
+	wg.Wait()
+
+	if !silent {
+		log.Printf("[stream] %s %s closed after %s: %d bytes in, %d bytes out\n", s.config.Name, client, time.Since(start).Round(time.Millisecond), in, out)
+	}
+}
+
+// copy moves bytes from src to dst until either fails, adding them to counter as they go;
+// last is shared by both directions so that a connection is only idle when neither of them moves
+func (s *streamProxy) copy(dst, src net.Conn, counter, last *int64) int64 {
+	var (
+		total int64
+		buf   = make([]byte, 32*1024)
+	)
+
+	for {
+		if s.idle > 0 {
+			src.SetReadDeadline(time.Now().Add(s.idle))
+		}
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return total
+			}
+			total += int64(n)
+			atomic.AddInt64(counter, int64(n))
+			atomic.StoreInt64(last, time.Now().UnixNano())
+		}
+
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if time.Since(time.Unix(0, atomic.LoadInt64(last))) < s.idle {
+					continue
+				}
+
+				// the other direction must not outlive an idle timeout
+				dst.Close()
+			}
+			return total
+		}
+	}
+}
+
+type udpSession struct {
+	upstream *net.UDPConn
+	last     int64 // unix nano of the last packet
+}
+
+func (s *streamProxy) listenUDP() error {
+	pc, err := net.ListenPacket("udp", s.config.Listen)
+	if err != nil {
+		return err
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", s.config.Upstream)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	go s.serveUDP(pc, raddr)
+
+	return nil
+}
+
+// serveUDP relays datagrams; each client address gets its own upstream socket so that replies find their way back
+func (s *streamProxy) serveUDP(pc net.PacketConn, raddr *net.UDPAddr) {
+	var (
+		mu       sync.Mutex
+		sessions = make(map[string]*udpSession)
+		buf      = make([]byte, 64*1024)
+	)
+
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Printf("[stream] %s stopped reading: %s\n", s.config.Name, err)
+			return
+		}
+
+		client := addr.String()
+
+		mu.Lock()
+		session, exists := sessions[client]
+		if !exists {
+			upstream, err := net.DialUDP("udp", nil, raddr)
+			if err != nil {
+				mu.Unlock()
+				atomic.AddInt64(&s.errored, 1)
+				log.Printf("[stream] %s %s: upstream unreachable: %s\n", s.config.Name, client, err)
+				continue
+			}
+
+			session = &udpSession{upstream: upstream}
+			sessions[client] = session
+			atomic.AddInt64(&s.total, 1)
+			atomic.AddInt64(&s.active, 1)
+
+			if !silent {
+				log.Printf("[stream] %s %s connected\n", s.config.Name, client)
+			}
+
+			go func() {
+				s.replyUDP(pc, addr, session)
+
+				mu.Lock()
+				delete(sessions, client)
+				mu.Unlock()
+
+				atomic.AddInt64(&s.active, -1)
+				if !silent {
+					log.Printf("[stream] %s %s expired\n", s.config.Name, client)
+				}
+			}()
+		}
+		atomic.StoreInt64(&session.last, time.Now().UnixNano())
+		mu.Unlock()
+
+		if _, err := session.upstream.Write(buf[:n]); err == nil {
+			atomic.AddInt64(&s.in, int64(n))
+		}
+	}
+}
+
+// replyUDP sends upstream replies to the client until the session has been idle for too long
+func (s *streamProxy) replyUDP(pc net.PacketConn, addr net.Addr, session *udpSession) {
+	buf := make([]byte, 64*1024)
+
+	defer session.upstream.Close()
+
+	for {
+		session.upstream.SetReadDeadline(time.Now().Add(s.idle))
+
+		n, err := session.upstream.Read(buf)
+		if n > 0 {
+			if _, err := pc.WriteTo(buf[:n], addr); err == nil {
+				atomic.AddInt64(&s.out, int64(n))
+			}
+		}
+
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if time.Since(time.Unix(0, atomic.LoadInt64(&session.last))) < s.idle {
+					continue
+				}
+				return
+			}
+
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// e.g. connection refused reported by icmp; the client may send again once upstream is up
+		}
+	}
+}
+
+func (s *streamProxy) stats() StreamStats {
+	return StreamStats{
+		Name:     s.config.Name,
+		Protocol: s.config.Protocol,
+		Listen:   s.config.Listen,
+		Upstream: s.config.Upstream,
+		Active:   atomic.LoadInt64(&s.active),
+		Total:    atomic.LoadInt64(&s.total),
+		BytesIn:  atomic.LoadInt64(&s.in),
+		BytesOut: atomic.LoadInt64(&s.out),
+		Errors:   atomic.LoadInt64(&s.errored),
+		TLS:      s.tls != nil,
+	}
+}
+
+// streamsHandler lists streams with their connection and byte counters
+func streamsHandler(w http.ResponseWriter, r *http.Request) {
+	list := []StreamStats{}
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	for _, s := range streams {
+		list = append(list, s.stats())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// closeWrite half-closes c when supported so that the peer receives EOF, otherwise it closes c
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+		return
+	}
+
+	c.Close()
+}
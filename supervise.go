@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	restartNo        = "no"
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+
+	defaultRestartBackoff = time.Second
+	maxRestartBackoff     = time.Minute
+
+	// a service running for this long is healthy again: its backoff and retries are reset
+	stableUptime = 30 * time.Second
+
+	// a service exiting this many times within the window, each time before it is stable, is crash looping
+	crashLoopExits  = 5
+	crashLoopWindow = 2 * time.Minute
+)
+
+// supervisor runs a service, waits for it to exit and restarts it according to its policy
+type supervisor struct {
+	service    Service
+	policy     string
+	maxRetries int
+	backoff    time.Duration
+
+	mu        sync.Mutex
+	process   *os.Process
+	running   bool
+	reloading bool
+	stopping  bool // set when gorexy stops, the service is never started again
+	wake      chan struct{}
+	done      chan struct{} // closed once the service is no longer supervised
+}
+
+// supervisorList keeps the supervisors of all services, so that they are stopped along with gorexy
+type supervisorList struct {
+	mu   sync.Mutex
+	list []*supervisor
+}
+
+var supervisors = new(supervisorList)
+
+func (l *supervisorList) add(s *supervisor) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.list = append(l.list, s)
+}
+
+// stopServices stops all services at once and waits for them to exit
+func stopServices() {
+	supervisors.mu.Lock()
+	list := supervisors.list
+	supervisors.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range list {
+		wg.Add(1)
+		go func(s *supervisor) {
+			defer wg.Done()
+			s.shutdown()
+		}(s)
+	}
+	wg.Wait()
+}
+
+// newSupervisor expects the command, arguments and directory of service to be resolved already
+func newSupervisor(service Service) (*supervisor, error) {
+	s := &supervisor{
+		service:    service,
+		policy:     service.Restart,
+		maxRetries: service.MaxRetries,
+		backoff:    defaultRestartBackoff,
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+
+	switch s.policy {
+	case "":
+		s.policy = restartNo
+	case restartNo, restartOnFailure, restartAlways:
+	default:
+		return nil, fmt.Errorf("invalid restart for %s: %s, must be one of %s, %s or %s", service.Name, s.policy, restartNo, restartOnFailure, restartAlways)
+	}
+
+	if s.maxRetries < 0 {
+		return nil, fmt.Errorf("invalid max_retries for %s: %d", service.Name, s.maxRetries)
+	}
+
+	if service.RestartBackoff != "" {
+		var err error
+		if s.backoff, err = time.ParseDuration(service.RestartBackoff); err != nil || s.backoff <= 0 {
+			return nil, fmt.Errorf("invalid restart_backoff for %s: %s", service.Name, service.RestartBackoff)
+		}
+	}
+
+	return s, nil
+}
+
+// command returns a new command for each run, a command cannot be started twice
+func (s *supervisor) command() *exec.Cmd {
+	var cmd *exec.Cmd
+
+	if s.service.Args == "" {
+		cmd = exec.Command(s.service.Cmd)
+	} else {
+		args := strings.Split(s.service.Args, " ")
+		cmd = exec.Command(s.service.Cmd, args...)
+	}
+
+	if s.service.Dir != "" {
+		cmd.Dir = s.service.Dir
+	}
+
+	if s.service.Env != "" {
+		cmd.Env = strings.Split(s.service.Env, " ")
+	}
+
+	if !silent && !s.service.Silent {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+
+	return cmd
+}
+
+// start runs the service in the background unless it is already supervised
+func (s *supervisor) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.running {
+		s.running = true
+		go s.run(false)
+	}
+}
+
+// run starts the service and restarts it whenever it exits, until the policy or the limits say otherwise
+func (s *supervisor) run(restarted bool) {
+	var (
+		name    = s.service.Name
+		retries = 0
+		delay   = s.backoff
+		exits   []time.Time
+	)
+
+	for {
+		if s.stopped() {
+			return
+		}
+
+		cmd := s.command()
+		started := time.Now()
+
+		err := cmd.Start()
+		if err == nil {
+			log.Printf("[started] %s (pid %d)\n", name, cmd.Process.Pid)
+
+			s.mu.Lock()
+			s.process = cmd.Process
+			if s.reloading {
+				// reloaded while starting
+				cmd.Process.Kill()
+			}
+			s.mu.Unlock()
+
+			if restarted {
+				liveReloadRestarted(name)
+			}
+
+			err = cmd.Wait()
+
+			s.mu.Lock()
+			s.process = nil
+			s.mu.Unlock()
+
+			log.Printf("[exited] %s - %s after %s\n", name, cmd.ProcessState, time.Since(started).Round(time.Millisecond))
+		} else {
+			log.Printf("[failed] %s - %s\n", name, err)
+		}
+		restarted = true
+
+		if s.stopped() {
+			return
+		}
+
+		// reloads restart the service at once and do not count as failures
+		if s.reloaded() {
+			retries, delay, exits = 0, s.backoff, nil
+			continue
+		}
+
+		failed := err != nil
+		if s.policy == restartNo || (s.policy == restartOnFailure && !failed) {
+			s.stop()
+			return
+		}
+
+		uptime := time.Since(started)
+		if uptime >= stableUptime {
+			retries, delay, exits = 0, s.backoff, nil
+		} else {
+			exits = append(exits, time.Now())
+			for len(exits) > 0 && time.Since(exits[0]) > crashLoopWindow {
+				exits = exits[1:]
+			}
+
+			if len(exits) >= crashLoopExits {
+				log.Printf("[crash loop] %s exited %d times within %s, it will not be restarted until it is reloaded or gorexy restarts\n", name, len(exits), crashLoopWindow)
+				s.stop()
+				return
+			}
+		}
+
+		if s.maxRetries > 0 && retries >= s.maxRetries {
+			log.Printf("[gave up] %s - not restarted after %d retries\n", name, retries)
+			s.stop()
+			return
+		}
+		retries++
+
+		// websockets are closed before a restart like they are before a reload
+		sessions.closeService(s.service)
+
+		log.Printf("[restarting] %s in %s\n", name, delay)
+		select {
+		case <-time.After(delay):
+		case <-s.wake:
+			if s.stopped() {
+				return
+			}
+			s.reloaded()
+			retries, delay, exits = 0, s.backoff, nil
+			continue
+		}
+
+		if delay *= 2; delay > maxRestartBackoff {
+			delay = maxRestartBackoff
+		}
+	}
+}
+
+// stop marks the service as no longer supervised, unless a reload is pending in which case it is run again
+func (s *supervisor) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reloading && !s.stopping {
+		s.reloading = false
+		go s.run(true)
+		return
+	}
+
+	s.running = false
+	if s.stopping {
+		close(s.done)
+	}
+}
+
+// stopped reports whether gorexy is stopping, in which case the service is no longer supervised
+func (s *supervisor) stopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.stopping {
+		return false
+	}
+
+	if s.running {
+		s.running = false
+		close(s.done)
+	}
+
+	return true
+}
+
+// shutdown terminates the service for good, killing it when it does not exit within shutdownTimeout
+func (s *supervisor) shutdown() {
+	s.mu.Lock()
+	s.stopping = true
+	running, process := s.running, s.process
+	s.mu.Unlock()
+
+	if !running {
+		return
+	}
+
+	// wakes the supervisor up when it waits to restart the service
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	if process != nil {
+		if process.Signal(syscall.SIGTERM) != nil {
+			process.Kill()
+		}
+	}
+
+	select {
+	case <-s.done:
+	case <-time.After(shutdownTimeout):
+		log.Printf("[killed] %s did not stop within %s\n", s.service.Name, shutdownTimeout)
+		if process != nil {
+			process.Kill()
+		}
+		<-s.done
+	}
+}
+
+// reloaded reports, and clears, a pending reload
+func (s *supervisor) reloaded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reloading := s.reloading
+	s.reloading = false
+
+	select {
+	case <-s.wake:
+	default:
+	}
+
+	return reloading
+}
+
+// reload restarts the service at once, including services which stopped or gave up
+func (s *supervisor) reload() {
+	sessions.closeService(s.service)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopping {
+		return
+	}
+
+	if !s.running {
+		s.running = true
+		go s.run(true)
+		return
+	}
+
+	s.reloading = true
+	if s.process != nil {
+		s.process.Kill()
+		return
+	}
+
+	// waiting to restart
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// supervisors notify mappings of restarts while gorexy sets its proxies up, run with -race
+func TestReloadWhileSettingProxies(t *testing.T) {
+	silent = true
+
+	s, err := newSupervisor(Service{Name: "sleep", Cmd: "sleep", Args: "0.01", Restart: restartAlways, RestartBackoff: "1ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.start()
+	defer s.shutdown()
+
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		proxies.set([]HTTPProxy{{Prefix: "/"}}, nil)
+		s.reload()
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fluxynet/gorexy/wsutils"
+)
+
+const throttleOff = "off"
+
+// Throttle represents network condition emulation settings
+type Throttle struct {
+	Profiles map[string]ThrottleProfile `json:"profiles"`
+	Clients  map[string]string          `json:"clients"`
+	Header   string                     `json:"header"`
+	Cookie   string                     `json:"cookie"`
+}
+
+// ThrottleProfile represents network conditions; bandwidths are in kbps
+type ThrottleProfile struct {
+	Down int    `json:"down"`
+	Up   int    `json:"up"`
+	RTT  string `json:"rtt"`
+}
+
+var defaultThrottleProfiles = map[string]ThrottleProfile{
+	"2g":      {Down: 250, Up: 50, RTT: "300ms"},
+	"3g":      {Down: 400, Up: 400, RTT: "400ms"},
+	"slow-4g": {Down: 1600, Up: 750, RTT: "150ms"},
+	"fast-4g": {Down: 9000, Up: 1500, RTT: "60ms"},
+}
+
+type throttleProfile struct {
+	name string
+	down int // bytes per second
+	up   int
+	rtt  time.Duration
+}
+
+type throttleProfileKey struct{}
+
+type throttleClient struct {
+	network *net.IPNet
+	ip      net.IP
+	profile string
+}
+
+type throttler struct {
+	profiles map[string]*throttleProfile
+	clients  []throttleClient
+	header   string
+	cookie   string
+}
+
+func newThrottler(config Throttle) (*throttler, error) {
+	t := &throttler{
+		profiles: make(map[string]*throttleProfile),
+		header:   config.Header,
+		cookie:   config.Cookie,
+	}
+
+	if t.header == "" {
+		t.header = "X-Gorexy-Throttle"
+	}
+
+	if t.cookie == "" {
+		t.cookie = "gorexy_throttle"
+	}
+
+	for _, profiles := range []map[string]ThrottleProfile{defaultThrottleProfiles, config.Profiles} {
+		for name, p := range profiles {
+			profile := &throttleProfile{name: name, down: p.Down * 1000 / 8, up: p.Up * 1000 / 8}
+			if p.RTT != "" {
+				rtt, err := time.ParseDuration(p.RTT)
+				if err != nil {
+					return nil, fmt.Errorf("invalid rtt %s for throttle profile %s: %s", p.RTT, name, err)
+				}
+				profile.rtt = rtt
+			}
+			t.profiles[name] = profile
+		}
+	}
+
+	for client, name := range config.Clients {
+		if err := t.validate(name); err != nil {
+			return nil, err
+		}
+
+		c := throttleClient{profile: name}
+		if strings.Contains(client, "/") {
+			_, network, err := net.ParseCIDR(client)
+			if err != nil {
+				return nil, fmt.Errorf("invalid throttle client %s: %s", client, err)
+			}
+			c.network = network
+		} else if c.ip = net.ParseIP(client); c.ip == nil {
+			return nil, fmt.Errorf("invalid throttle client %s", client)
+		}
+		t.clients = append(t.clients, c)
+	}
+
+	return t, nil
+}
+
+func (t *throttler) validate(name string) error {
+	if _, exists := t.profiles[name]; name != "" && name != throttleOff && !exists {
+		return fmt.Errorf("unknown throttle profile %s", name)
+	}
+
+	return nil
+}
+
+// profile selects the profile of r: the header or cookie wins over the client address, which wins over the mapping
+func (t *throttler) profile(r *http.Request, mapping string) *throttleProfile {
+	name := r.Header.Get(t.header)
+	if name == "" {
+		if c, err := r.Cookie(t.cookie); err == nil {
+			name = c.Value
+		}
+	}
+
+	if name == "" {
+		ip := net.ParseIP(clientIP(r))
+		for _, c := range t.clients {
+			if (c.network != nil && c.network.Contains(ip)) || c.ip.Equal(ip) {
+				name = c.profile
+				break
+			}
+		}
+	}
+
+	if name == "" {
+		name = mapping
+	}
+
+	return t.profiles[name]
+}
+
+// handler shapes request and response bodies of next according to the profile of each request
+func (t *throttler) handler(next http.Handler, mapping string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := t.profile(r, mapping)
+		r.Header.Del(t.header)
+
+		if p == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if p.rtt > 0 {
+			select {
+			case <-time.After(p.rtt):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if wsutils.Upgrade(r) != "" {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), throttleProfileKey{}, p)))
+			return
+		}
+
+		if p.up > 0 && r.Body != nil {
+			r.Body = &throttledReadCloser{ReadCloser: r.Body, pacer: &pacer{rate: p.up}}
+		}
+
+		if p.down > 0 {
+			w = &throttledResponseWriter{ResponseWriter: w, pacer: &pacer{rate: p.down}}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// throttleStreams shapes both directions of an upgraded connection according to the profile selected by handler
+func throttleStreams(r *http.Request, w io.Writer, upstream bool) io.Writer {
+	p, _ := r.Context().Value(throttleProfileKey{}).(*throttleProfile)
+	if p == nil {
+		return w
+	}
+
+	rate := p.down
+	if upstream {
+		rate = p.up
+	}
+
+	if rate <= 0 {
+		return w
+	}
+
+	return &throttledWriter{Writer: w, pacer: &pacer{rate: rate}}
+}
+
+// pacer spreads bytes over time so that they flow at rate bytes per second
+type pacer struct {
+	mu   sync.Mutex
+	rate int
+	next time.Time
+}
+
+// chunk returns how many bytes may be sent in one go
+func (p *pacer) chunk(n int) int {
+	max := p.rate / 20
+	if max < 512 {
+		max = 512
+	}
+
+	if n > max {
+		return max
+	}
+
+	return n
+}
+
+// wait blocks until n bytes may be sent
+func (p *pacer) wait(n int) {
+	p.mu.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	due := p.next
+	p.next = p.next.Add(time.Duration(n) * time.Second / time.Duration(p.rate))
+	p.mu.Unlock()
+
+	time.Sleep(due.Sub(now))
+}
+
+type throttledWriter struct {
+	io.Writer
+	pacer *pacer
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+
+	for len(b) > 0 {
+		n := w.pacer.chunk(len(b))
+		w.pacer.wait(n)
+
+		m, err := w.Writer.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	pacer *pacer
+}
+
+func (w *throttledResponseWriter) Write(b []byte) (int, error) {
+	written := 0
+
+	for len(b) > 0 {
+		n := w.pacer.chunk(len(b))
+		w.pacer.wait(n)
+
+		m, err := w.ResponseWriter.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+
+		// data must reach the client as it is paced, not when the server's buffer fills up
+		w.Flush()
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+func (w *throttledResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *throttledResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type throttledReadCloser struct {
+	io.ReadCloser
+	pacer *pacer
+}
+
+func (r *throttledReadCloser) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	n := r.pacer.chunk(len(b))
+	r.pacer.wait(n)
+
+	return r.ReadCloser.Read(b[:n])
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fluxynet/gorexy/wsutils"
+)
+
+const (
+	wsMockMapping = "ws-mock"
+
+	// wsMockMaxMessage is the biggest message a ws-mock mapping accepts from clients
+	wsMockMaxMessage = 16 << 20
+
+	// wsMockCloseGrace is how long clients have to answer a close frame
+	wsMockCloseGrace = 5 * time.Second
+)
+
+// WSMock represents the script played by a ws-mock mapping, defined inline or in fixture files
+type WSMock struct {
+	Dir       string          `json:"dir"`
+	OnConnect []WSMockMessage `json:"on_connect"`
+	Rules     []WSMockRule    `json:"rules"`
+	Pushes    []WSMockPush    `json:"pushes"`
+}
+
+// WSMockMessage represents a message sent by a ws-mock mapping
+type WSMockMessage struct {
+	Text   string          `json:"text"`
+	JSON   json.RawMessage `json:"json"`
+	Binary string          `json:"binary"`
+	File   string          `json:"file"`
+	Delay  string          `json:"delay"`
+}
+
+// WSMockRule represents the messages answering client messages which match a pattern
+type WSMockRule struct {
+	Match string          `json:"match"`
+	Reply []WSMockMessage `json:"reply"`
+}
+
+// WSMockPush represents a message sent some time after connecting, optionally repeated
+type WSMockPush struct {
+	WSMockMessage
+	After string `json:"after"`
+	Every string `json:"every"`
+}
+
+// wsMockData is made available to message templates
+type wsMockData struct {
+	Message string
+	Groups  []string
+	JSON    interface{}
+	Path    string
+	Query   map[string]string
+	Headers map[string]string
+}
+
+type wsMockMessage struct {
+	body   *template.Template
+	data   []byte
+	binary bool
+	delay  time.Duration
+	source string
+}
+
+type wsMockRule struct {
+	match *regexp.Regexp
+	reply []*wsMockMessage
+}
+
+type wsMockPush struct {
+	message *wsMockMessage
+	after   time.Duration
+	every   time.Duration
+}
+
+type wsMockScript struct {
+	onConnect []*wsMockMessage
+	rules     []*wsMockRule
+	pushes    []*wsMockPush
+}
+
+type wsMockServer struct {
+	mapping string
+	dir     string
+	inline  *wsMockScript
+
+	mu     sync.RWMutex
+	script *wsMockScript
+}
+
+func newWSMockServer(config *WSMock, mapping string) (*wsMockServer, error) {
+	var err error
+
+	if config == nil {
+		return nil, fmt.Errorf("ws_mock must define dir, on_connect, rules or pushes")
+	}
+
+	m := &wsMockServer{mapping: mapping}
+
+	if config.Dir != "" {
+		m.dir = normalizePath(config.Dir, true)
+	}
+
+	if m.inline, err = compileWSMock(*config, m.dir, "inline"); err != nil {
+		return nil, err
+	}
+
+	if err = m.load(); err != nil {
+		return nil, err
+	}
+
+	if m.dir != "" {
+		if err = watchFixtures(m.dir, "ws-mock", m.load); err != nil {
+			return nil, fmt.Errorf("failed to watch %s: %s", m.dir, err)
+		}
+	}
+
+	return m, nil
+}
+
+// load (re)reads fixture files, which add to the inline script
+func (m *wsMockServer) load() error {
+	script := &wsMockScript{}
+	script.add(m.inline)
+
+	if m.dir != "" {
+		files, err := filepath.Glob(filepath.Join(m.dir, "*.json"))
+		if err != nil {
+			return err
+		}
+		sort.Strings(files)
+
+		for _, file := range files {
+			var config WSMock
+
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+
+			if err = json.Unmarshal(data, &config); err != nil {
+				return fmt.Errorf("invalid fixture %s: %s", file, err)
+			}
+
+			fixture, err := compileWSMock(config, m.dir, filepath.Base(file))
+			if err != nil {
+				return err
+			}
+			script.add(fixture)
+		}
+	}
+
+	m.mu.Lock()
+	m.script = script
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (s *wsMockScript) add(other *wsMockScript) {
+	s.onConnect = append(s.onConnect, other.onConnect...)
+	s.rules = append(s.rules, other.rules...)
+	s.pushes = append(s.pushes, other.pushes...)
+}
+
+func compileWSMock(config WSMock, dir, source string) (*wsMockScript, error) {
+	script := &wsMockScript{}
+
+	for i, c := range config.OnConnect {
+		message, err := compileWSMockMessage(c, dir, fmt.Sprintf("%s on_connect %d", source, i+1))
+		if err != nil {
+			return nil, err
+		}
+		script.onConnect = append(script.onConnect, message)
+	}
+
+	for i, c := range config.Rules {
+		var (
+			err  error
+			rule = &wsMockRule{}
+			name = fmt.Sprintf("%s rule %d", source, i+1)
+		)
+
+		if c.Match != "" {
+			if rule.match, err = regexp.Compile(c.Match); err != nil {
+				return nil, fmt.Errorf("ws-mock %s: invalid match %s: %s", name, c.Match, err)
+			}
+		}
+
+		for j, r := range c.Reply {
+			message, err := compileWSMockMessage(r, dir, fmt.Sprintf("%s reply %d", name, j+1))
+			if err != nil {
+				return nil, err
+			}
+			rule.reply = append(rule.reply, message)
+		}
+
+		script.rules = append(script.rules, rule)
+	}
+
+	for i, c := range config.Pushes {
+		var (
+			err  error
+			push = &wsMockPush{}
+			name = fmt.Sprintf("%s push %d", source, i+1)
+		)
+
+		if c.After != "" {
+			if push.after, err = time.ParseDuration(c.After); err != nil {
+				return nil, fmt.Errorf("ws-mock %s: invalid after %s: %s", name, c.After, err)
+			}
+		}
+
+		if c.Every != "" {
+			if push.every, err = time.ParseDuration(c.Every); err != nil || push.every <= 0 {
+				return nil, fmt.Errorf("ws-mock %s: invalid every %s", name, c.Every)
+			}
+		}
+
+		if push.message, err = compileWSMockMessage(c.WSMockMessage, dir, name); err != nil {
+			return nil, err
+		}
+
+		script.pushes = append(script.pushes, push)
+	}
+
+	return script, nil
+}
+
+func compileWSMockMessage(c WSMockMessage, dir, source string) (*wsMockMessage, error) {
+	var (
+		err     error
+		message = &wsMockMessage{source: source}
+		body    = c.Text
+	)
+
+	if c.Delay != "" {
+		if message.delay, err = time.ParseDuration(c.Delay); err != nil {
+			return nil, fmt.Errorf("ws-mock %s: invalid delay %s: %s", source, c.Delay, err)
+		}
+	}
+
+	switch {
+	case len(c.JSON) > 0:
+		body = string(c.JSON)
+	case c.Binary != "":
+		if message.data, err = base64.StdEncoding.DecodeString(c.Binary); err != nil {
+			return nil, fmt.Errorf("ws-mock %s: invalid base64 binary: %s", source, err)
+		}
+		message.binary = true
+		return message, nil
+	case c.File != "":
+		file := normalizePath(c.File, false)
+		if !filepath.IsAbs(file) && dir != "" {
+			file = filepath.Join(dir, file)
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("ws-mock %s: %s", source, err)
+		}
+
+		if !utf8.Valid(data) {
+			message.data, message.binary = data, true
+			return message, nil
+		}
+		body = string(data)
+	case c.Text == "":
+		return nil, fmt.Errorf("ws-mock %s: message must define text, json, binary or file", source)
+	}
+
+	if message.body, err = template.New(source).Parse(body); err != nil {
+		return nil, fmt.Errorf("ws-mock %s: invalid template: %s", source, err)
+	}
+
+	return message, nil
+}
+
+// ServeHTTP answers the websocket handshake and plays the script of the mapping until the connection ends
+func (m *wsMockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-Websocket-Key")
+	if !wsutils.IsWebsocket(r) || (key == "" && !wsutils.ExtendedConnect(r)) {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "Websocket required", http.StatusUpgradeRequired)
+		return
+	}
+
+	header := make(http.Header)
+	if protocols := r.Header.Get("Sec-Websocket-Protocol"); protocols != "" {
+		// clients offering subprotocols expect one of them to be chosen
+		header.Set("Sec-WebSocket-Protocol", strings.TrimSpace(strings.Split(protocols, ",")[0]))
+	}
+
+	nc, reader, err := m.accept(w, r, header)
+	if err != nil {
+		log.Printf("Error accepting websocket for %s: %v", r.URL.Path, err)
+		return
+	}
+	defer nc.Close()
+
+	m.mu.RLock()
+	script := m.script
+	m.mu.RUnlock()
+
+	c := &wsMockConn{
+		conn:   nc,
+		w:      throttleStreams(r, nc, false),
+		done:   make(chan struct{}),
+		inbox:  make(chan []byte, 16),
+		script: script,
+		data:   wsMockData{Path: r.URL.Path, Query: make(map[string]string), Headers: make(map[string]string)},
+	}
+
+	for k := range r.URL.Query() {
+		c.data.Query[k] = r.URL.Query().Get(k)
+	}
+
+	for k := range r.Header {
+		c.data.Headers[k] = r.Header.Get(k)
+	}
+
+	sessions.open(m.mapping, r, wsMockMapping+"://", c)
+	defer sessions.closed(c)
+	defer close(c.done)
+
+	go c.play(script.onConnect, c.data)
+	go c.replies()
+
+	for _, push := range script.pushes {
+		go c.push(push)
+	}
+
+	c.serve(reader)
+}
+
+// accept completes the handshake with the client, over HTTP/1.1 or an HTTP/2 stream, and returns its connection
+func (m *wsMockServer) accept(w http.ResponseWriter, r *http.Request, header http.Header) (net.Conn, io.Reader, error) {
+	if wsutils.ExtendedConnect(r) {
+		nc, err := wsutils.AcceptStream(w, r, header)
+		return nc, nc, err
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Not a hijacker?", http.StatusInternalServerError)
+		return nil, nil, fmt.Errorf("not a hijacker")
+	}
+
+	nc, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nc.SetDeadline(time.Time{})
+
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Accept", wsutils.AcceptKey(r.Header.Get("Sec-Websocket-Key")))
+
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	header.Write(brw)
+	brw.WriteString("\r\n")
+	if err = brw.Flush(); err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+
+	return nc, brw.Reader, nil
+}
+
+// wsMockConn is a websocket connection answered by a ws-mock mapping
+type wsMockConn struct {
+	conn   net.Conn
+	w      io.Writer
+	done   chan struct{}
+	inbox  chan []byte
+	script *wsMockScript
+	data   wsMockData
+
+	mu     sync.Mutex
+	closed bool
+	up     int64
+	down   int64
+}
+
+// serve reads client messages until the connection ends, answering control frames and matching rules
+func (c *wsMockConn) serve(r io.Reader) {
+	var message bytes.Buffer
+
+	for {
+		f, err := wsutils.ReadFrame(r, wsMockMaxMessage-message.Len())
+		if err != nil {
+			if err == wsutils.ErrFrameTooBig {
+				c.Close(1009, "Message too big")
+			}
+			return
+		}
+		atomic.AddInt64(&c.up, int64(len(f.Payload)))
+
+		switch f.Opcode {
+		case 0x8:
+			code := f.Payload
+			if len(code) > 2 {
+				code = code[:2]
+			}
+			// the answer to a close frame sent by us is the end of the connection
+			c.write(0x8, code)
+			return
+		case 0x9:
+			c.write(0xa, f.Payload)
+			continue
+		case 0xa:
+			continue
+		case 0x0:
+		default:
+			message.Reset()
+		}
+
+		message.Write(f.Payload)
+		if f.Fin {
+			select {
+			case c.inbox <- append([]byte{}, message.Bytes()...):
+			case <-c.done:
+				return
+			}
+		}
+	}
+}
+
+// replies answers client messages in the order they were received
+func (c *wsMockConn) replies() {
+	for {
+		select {
+		case message := <-c.inbox:
+			c.reply(message)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// reply plays the replies of the first rule matching a client message
+func (c *wsMockConn) reply(message []byte) {
+	data := c.data
+	data.Message = string(message)
+	json.Unmarshal(message, &data.JSON)
+
+	for _, rule := range c.script.rules {
+		if rule.match != nil {
+			if data.Groups = rule.match.FindStringSubmatch(data.Message); data.Groups == nil {
+				continue
+			}
+		}
+
+		c.play(rule.reply, data)
+		return
+	}
+}
+
+// push sends a message after its delay, then repeatedly if it has an interval
+func (c *wsMockConn) push(push *wsMockPush) {
+	if !c.wait(push.after) {
+		return
+	}
+
+	for {
+		c.play([]*wsMockMessage{push.message}, c.data)
+
+		if push.every == 0 || !c.wait(push.every) {
+			return
+		}
+	}
+}
+
+// play sends messages in order, each after its delay
+func (c *wsMockConn) play(messages []*wsMockMessage, data wsMockData) {
+	for _, message := range messages {
+		if !c.wait(message.delay) {
+			return
+		}
+
+		if message.binary {
+			c.write(0x2, message.data)
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := message.body.Execute(&buf, data); err != nil {
+			log.Printf("[ws-mock failed] %s: %s\n", message.source, err)
+			continue
+		}
+
+		if c.write(0x1, buf.Bytes()) != nil {
+			return
+		}
+	}
+}
+
+// wait returns false if the connection ends before d elapses
+func (c *wsMockConn) wait(d time.Duration) bool {
+	if d <= 0 {
+		select {
+		case <-c.done:
+			return false
+		default:
+			return true
+		}
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c *wsMockConn) write(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return wsutils.ErrClosed
+	}
+	c.closed = opcode == 0x8
+
+	n, err := c.w.Write(wsutils.AppendFrame(nil, opcode, payload, false))
+	atomic.AddInt64(&c.down, int64(n))
+
+	return err
+}
+
+func (c *wsMockConn) BytesUp() int64 {
+	return atomic.LoadInt64(&c.up)
+}
+
+func (c *wsMockConn) BytesDown() int64 {
+	return atomic.LoadInt64(&c.down)
+}
+
+func (c *wsMockConn) Send(binary bool, payload []byte) error {
+	opcode := byte(0x1)
+	if binary {
+		opcode = 0x2
+	}
+
+	return c.write(opcode, payload)
+}
+
+// Close sends a close frame and gives the client a grace period to answer it
+func (c *wsMockConn) Close(code int, reason string) {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+
+	if c.write(0x8, payload) == nil {
+		c.conn.SetReadDeadline(time.Now().Add(wsMockCloseGrace))
+	}
+}
@@ -0,0 +1,253 @@
+package wsutils
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ErrFrameTooBig is returned when a frame exceeds the size allowed to be read
+var ErrFrameTooBig = errors.New("websocket frame too big")
+
+// Frame represents a single websocket frame
+type Frame struct {
+	Fin     bool
+	Opcode  byte
+	Payload []byte // unmasked
+}
+
+// ReadFrame reads a frame of at most max bytes of payload from r
+func ReadFrame(r io.Reader, max int) (Frame, error) {
+	var header [14]byte
+
+	if _, err := io.ReadFull(r, header[:2]); err != nil {
+		return Frame{}, err
+	}
+
+	n := 2 + extendedLength(header[1]&0x7f)
+	masked := header[1]&0x80 != 0
+	if masked {
+		n += 4
+	}
+
+	if _, err := io.ReadFull(r, header[2:n]); err != nil {
+		return Frame{}, err
+	}
+
+	h := parseHeader(header[:n])
+	if h.length > uint64(max) {
+		return Frame{}, ErrFrameTooBig
+	}
+
+	f := Frame{Fin: h.fin, Opcode: h.opcode, Payload: make([]byte, h.length)}
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return Frame{}, err
+	}
+
+	if h.masked {
+		h.unmask(f.Payload, 0)
+	}
+
+	return f, nil
+}
+
+// AppendFrame appends a complete frame to b; frames sent by clients must be masked
+func AppendFrame(b []byte, opcode byte, payload []byte, masked bool) []byte {
+	var bit byte
+	if masked {
+		bit = 0x80
+	}
+
+	b = append(b, 0x80|opcode)
+
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, bit|byte(n))
+	case n <= 0xffff:
+		b = append(b, bit|126, byte(n>>8), byte(n))
+	default:
+		b = append(b, bit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+
+	if !masked {
+		return append(b, payload...)
+	}
+
+	var mask [4]byte
+	rand.Read(mask[:])
+	b = append(b, mask[:]...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+
+	return b
+}
+
+// AcceptKey returns the Sec-WebSocket-Accept value answering a Sec-WebSocket-Key
+func AcceptKey(key string) string {
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// MessageCounter counts complete data messages in a stream of websocket frames
+// Frames may be fed in arbitrary chunks; control frames are not counted
+type MessageCounter struct {
+	frames  frameParser
+	last    bool // whether the current frame ends a data message
+	partial bool // whether a fragmented data message has been started and not ended
+}
+
+// Count consumes p and returns the number of messages completed in it
+func (c *MessageCounter) Count(p []byte) int {
+	var (
+		count          int
+		started, ended bool
+	)
+
+	for len(p) > 0 {
+		_, started, ended, p = c.frames.next(p)
+
+		if started {
+			h := c.frames.header
+			c.last = h.fin && h.opcode < 0x8
+			if h.opcode < 0x8 {
+				c.partial = !h.fin
+			}
+		}
+
+		if ended && c.last {
+			count++
+		}
+	}
+
+	return count
+}
+
+// frameHeader is the decoded header of a websocket frame
+type frameHeader struct {
+	fin    bool
+	rsv1   bool // set on the first frame of compressed messages
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length uint64
+}
+
+// parseHeader decodes a complete frame header
+func parseHeader(b []byte) frameHeader {
+	h := frameHeader{
+		fin:    b[0]&0x80 != 0,
+		rsv1:   b[0]&0x40 != 0,
+		opcode: b[0] & 0x0f,
+		masked: b[1]&0x80 != 0,
+		length: payloadLength(b),
+	}
+
+	if h.masked {
+		copy(h.mask[:], b[len(b)-4:])
+	}
+
+	return h
+}
+
+// unmask unmasks p, found at offset in the payload of the frame
+func (h *frameHeader) unmask(p []byte, offset int) {
+	for i := range p {
+		p[i] ^= h.mask[(offset+i)%4]
+	}
+}
+
+// frameParser splits a stream of websocket frames fed in arbitrary chunks into headers and payloads
+type frameParser struct {
+	header    frameHeader // of the current frame
+	buf       [14]byte
+	have      int
+	need      int
+	remaining uint64 // payload of the current frame not consumed yet
+}
+
+// next consumes the beginning of p, either part of a frame header or part of a payload, and returns the rest of p;
+// started is set once a header is complete and ended once the payload of its frame is
+func (f *frameParser) next(p []byte) (payload []byte, started, ended bool, rest []byte) {
+	if f.remaining > 0 {
+		n := uint64(len(p))
+		if n > f.remaining {
+			n = f.remaining
+		}
+		f.remaining -= n
+
+		return p[:n], false, f.remaining == 0, p[n:]
+	}
+
+	if f.need == 0 {
+		f.need = 2
+	}
+
+	n := copy(f.buf[f.have:f.need], p)
+	f.have += n
+	p = p[n:]
+
+	if f.have == 2 {
+		f.need = 2 + extendedLength(f.buf[1]&0x7f)
+		if f.buf[1]&0x80 != 0 {
+			f.need += 4
+		}
+	}
+
+	if f.have < f.need {
+		return nil, false, false, p
+	}
+
+	f.header = parseHeader(f.buf[:f.have])
+	f.remaining = f.header.length
+	f.have, f.need = 0, 0
+
+	return nil, true, f.remaining == 0, p
+}
+
+// boundary reports whether everything consumed so far ends a frame
+func (f *frameParser) boundary() bool {
+	return f.need == 0 && f.remaining == 0
+}
+
+func extendedLength(b byte) int {
+	switch b {
+	case 126:
+		return 2
+	case 127:
+		return 8
+	default:
+		return 0
+	}
+}
+
+func payloadLength(header []byte) uint64 {
+	length := uint64(header[1] & 0x7f)
+
+	switch length {
+	case 126:
+		length = uint64(header[2])<<8 | uint64(header[3])
+	case 127:
+		length = 0
+		for _, b := range header[2:10] {
+			length = length<<8 | uint64(b)
+		}
+	}
+
+	return length
+}
+
+// Boundary reports whether everything consumed so far ends on a frame boundary
+func (c *MessageCounter) Boundary() bool {
+	return c.frames.boundary()
+}
+
+// BetweenMessages reports whether everything consumed so far ends a data message, so that another may start
+func (c *MessageCounter) BetweenMessages() bool {
+	return c.Boundary() && !c.partial
+}
@@ -0,0 +1,145 @@
+package wsutils
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConnWrapper is implemented by response writers which wrap the connections they hand out, e.g. when hijacked,
+// so that the connections of HTTP/2 streams are wrapped as well
+type ConnWrapper interface {
+	WrapConn(c net.Conn) net.Conn
+}
+
+// ExtendedConnect reports whether r opens a connection over an HTTP/2 stream with an extended CONNECT (RFC 8441)
+func ExtendedConnect(r *http.Request) bool {
+	return r.Method == http.MethodConnect && r.Header.Get(":protocol") != ""
+}
+
+// AcceptStream answers an extended CONNECT with header and returns the connection carried by its stream
+// The handler must not return before the connection is closed
+func AcceptStream(w http.ResponseWriter, r *http.Request, header http.Header) (net.Conn, error) {
+	copyHeader(w.Header(), header)
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		return nil, err
+	}
+
+	var c net.Conn = &streamConn{w: w, rc: rc, body: r.Body, remote: streamAddr(r.RemoteAddr)}
+	if wc, ok := w.(ConnWrapper); ok {
+		c = wc.WrapConn(c)
+	}
+
+	return c, nil
+}
+
+// newKey returns a random Sec-WebSocket-Key
+func newKey() string {
+	var key [16]byte
+	rand.Read(key[:])
+
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+// streamConn reads the request body and writes the response body of an HTTP/2 stream
+type streamConn struct {
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	body   io.ReadCloser
+	remote net.Addr
+
+	mu        sync.Mutex
+	closed    bool
+	writeDone bool // set by CloseWrite
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the stream ends when the handler returns, nothing may be written afterwards
+	if c.closed || c.writeDone {
+		return 0, net.ErrClosed
+	}
+
+	n, err := c.w.Write(b)
+	if err == nil {
+		err = c.rc.Flush()
+	}
+
+	return n, err
+}
+
+// Close ends reading and unblocks pending reads; the stream itself ends when the handler returns
+func (c *streamConn) Close() error {
+	// a write blocked by flow control holds the lock, an expired deadline unblocks it but resets the stream
+	if !c.mu.TryLock() {
+		c.rc.SetWriteDeadline(time.Now())
+		c.mu.Lock()
+	}
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	return c.body.Close()
+}
+
+// CloseWrite stops writing while reads go on, so that the client may still answer a close frame.
+// A handler cannot end its response without returning: the peer only sees the end of the stream once the connection
+// is closed and the handler has returned
+func (c *streamConn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDone = true
+
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return streamAddr("")
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return c.rc.SetWriteDeadline(t)
+}
+
+type streamAddr string
+
+func (a streamAddr) Network() string {
+	return "http2"
+}
+
+func (a streamAddr) String() string {
+	return string(a)
+}
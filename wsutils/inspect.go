@@ -0,0 +1,193 @@
+package wsutils
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	// maxInspectedPayload is the biggest message an inspector reassembles
+	maxInspectedPayload = 16 << 20
+
+	// deflateWindow is the biggest window permessage-deflate may refer to
+	deflateWindow = 32 << 10
+)
+
+// Message represents a websocket message, or a control frame, seen by an inspector
+type Message struct {
+	Time       time.Time
+	FromClient bool
+	Opcode     byte
+	Payload    []byte // unmasked and decompressed
+	WireSize   int    // size of the payloads of the frames on the wire
+	Frames     int
+	Compressed bool
+	Truncated  bool // the message was too big to be kept, Payload is empty
+}
+
+// OpcodeName returns the name of the opcode of m
+func (m Message) OpcodeName() string {
+	switch m.Opcode {
+	case 0x0:
+		return "continuation"
+	case 0x1:
+		return "text"
+	case 0x2:
+		return "binary"
+	case 0x8:
+		return "close"
+	case 0x9:
+		return "ping"
+	case 0xa:
+		return "pong"
+	default:
+		return "unknown"
+	}
+}
+
+// inspector parses the frames of one direction of a connection and reports complete messages
+type inspector struct {
+	w          io.Writer
+	fromClient bool
+	deflate    bool
+	report     func(Message)
+
+	frames frameParser
+	offset int // position in the current frame's payload, for unmasking
+
+	// message being reassembled; control frames are reported on their own
+	message *Message
+	control *Message
+	data    bytes.Buffer
+	ctrl    bytes.Buffer
+	window  []byte // last decompressed bytes, which compressed messages may refer to
+}
+
+// newInspector tees w: data is written as is and frames are parsed on the way
+func newInspector(w io.Writer, fromClient, deflate bool, report func(Message)) *inspector {
+	return &inspector{w: w, fromClient: fromClient, deflate: deflate, report: report}
+}
+
+func (in *inspector) Write(b []byte) (int, error) {
+	n, err := in.w.Write(b)
+	in.parse(b[:n])
+
+	return n, err
+}
+
+func (in *inspector) parse(p []byte) {
+	var (
+		payload        []byte
+		started, ended bool
+	)
+
+	for len(p) > 0 {
+		payload, started, ended, p = in.frames.next(p)
+
+		if started {
+			in.startFrame()
+		} else if len(payload) > 0 {
+			in.consume(payload)
+		}
+
+		if ended {
+			in.endFrame()
+		}
+	}
+}
+
+func (in *inspector) startFrame() {
+	h := &in.frames.header
+	in.offset = 0
+
+	if h.opcode >= 0x8 {
+		in.control = &Message{Time: time.Now(), FromClient: in.fromClient, Opcode: h.opcode, Frames: 1, WireSize: int(h.length)}
+		in.ctrl.Reset()
+		return
+	}
+
+	if in.message == nil {
+		in.message = &Message{
+			Time:       time.Now(),
+			FromClient: in.fromClient,
+			Opcode:     h.opcode,
+			Compressed: in.deflate && h.rsv1,
+		}
+		in.data.Reset()
+	}
+
+	in.message.Frames++
+	in.message.WireSize += int(h.length)
+}
+
+func (in *inspector) consume(p []byte) {
+	h := &in.frames.header
+
+	buf := &in.data
+	if h.opcode >= 0x8 {
+		buf = &in.ctrl
+	} else if in.message.Truncated || buf.Len()+len(p) > maxInspectedPayload {
+		in.message.Truncated = true
+		in.offset += len(p)
+		return
+	}
+
+	start := buf.Len()
+	buf.Write(p)
+
+	if h.masked {
+		h.unmask(buf.Bytes()[start:], in.offset)
+	}
+	in.offset += len(p)
+}
+
+func (in *inspector) endFrame() {
+	h := &in.frames.header
+
+	if h.opcode >= 0x8 {
+		in.control.Payload = append([]byte{}, in.ctrl.Bytes()...)
+		in.report(*in.control)
+		in.control = nil
+		return
+	}
+
+	if !h.fin {
+		return
+	}
+
+	m := in.message
+	in.message = nil
+
+	switch {
+	case m.Truncated:
+		// the window is lost with the message, later compressed messages cannot be read
+		in.deflate = false
+	case m.Compressed:
+		m.Payload = in.inflate(in.data.Bytes())
+	default:
+		m.Payload = append([]byte{}, in.data.Bytes()...)
+	}
+
+	in.report(*m)
+}
+
+// inflate decompresses a permessage-deflate message; previous messages serve as dictionary for context takeover
+func (in *inspector) inflate(b []byte) []byte {
+	data := append(append([]byte{}, b...), 0x00, 0x00, 0xff, 0xff)
+
+	r := flate.NewReaderDict(bytes.NewReader(data), in.window)
+	out, err := ioutil.ReadAll(r)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return b
+	}
+
+	in.window = append(in.window, out...)
+	if len(in.window) > deflateWindow {
+		in.window = append([]byte{}, in.window[len(in.window)-deflateWindow:]...)
+	}
+
+	return out
+}
@@ -1,6 +1,9 @@
 package wsutils
 
 import (
+	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -8,78 +11,425 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
+// hopHeaders are removed from requests and responses, the upgrade headers are set again explicitly
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
 //ReverseProxy implements http.HandlerFunc to reverse proxy websocket requests
 type ReverseProxy struct {
 	Target string
+
+	//URL is the destination; its path is prefixed to request paths and its query merged with theirs
+	URL *url.URL
+
+	//Wrap optionally wraps the writer of each direction of a connection, e.g. to shape traffic
+	//upstream is true for data sent by the client to the backend
+	Wrap func(r *http.Request, w io.Writer, upstream bool) io.Writer
+
+	//DialTimeout limits the time spent connecting to the backend
+	DialTimeout time.Duration
+
+	//HandshakeTimeout limits the time the backend takes to answer the upgrade request
+	HandshakeTimeout time.Duration
+
+	//IdleTimeout closes connections on which nothing was received in either direction for this long
+	IdleTimeout time.Duration
+
+	//KeepAlive is the interval at which ping frames are sent to both the client and the backend, 0 disables pings
+	KeepAlive time.Duration
+
+	//Inspect optionally receives every websocket message and control frame going through a connection, in both directions
+	Inspect func(r *http.Request, m Message)
+
+	//Track is optionally called with open set once a connection is established, and again with open unset when it ends
+	Track func(s *Session, open bool)
 }
 
 //NewReverseProxy creates a new websocket reverse proxy
 func NewReverseProxy(url *url.URL) *ReverseProxy {
-	var proxy = new(ReverseProxy)
-	proxy.Target = fmt.Sprintf("%s:%s", url.Hostname(), url.Port())
+	var proxy = &ReverseProxy{
+		URL:              url,
+		DialTimeout:      10 * time.Second,
+		HandshakeTimeout: 10 * time.Second,
+	}
+
+	port := url.Port()
+	if port == "" {
+		port = "80"
+		if url.Scheme == "wss" || url.Scheme == "https" {
+			port = "443"
+		}
+	}
+	proxy.Target = net.JoinHostPort(url.Hostname(), port)
 
 	return proxy
 }
 
 func (ws *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	d, err := net.Dial("tcp", ws.Target)
+	if ExtendedConnect(r) && !IsWebsocket(r) {
+		// only websockets have an HTTP/1.1 handshake to bridge HTTP/2 streams to
+		http.Error(w, "Unsupported protocol "+Upgrade(r), http.StatusNotImplemented)
+		return
+	}
+
+	d, err := ws.dial()
 	if err != nil {
 		http.Error(w, "Error contacting backend server.", http.StatusBadGateway)
 		log.Printf("Error dialing websocket backend %s: %s", ws.Target, err)
 		return
 	}
 
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "Not a hijacker?", http.StatusInternalServerError)
+	defer d.Close()
+
+	if ws.HandshakeTimeout > 0 {
+		d.SetDeadline(time.Now().Add(ws.HandshakeTimeout))
+	}
+
+	outreq := ws.outgoing(r)
+
+	err = outreq.Write(d)
+	if err != nil {
+		http.Error(w, "Error contacting backend server.", http.StatusBadGateway)
+		log.Printf("Error copying request to target: %v", err)
 		return
 	}
 
-	nc, _, err := hj.Hijack()
+	br := bufio.NewReader(d)
+	res, err := http.ReadResponse(br, outreq)
 	if err != nil {
-		log.Printf("Hijack error: %v", err)
+		http.Error(w, "Invalid response from backend server.", http.StatusBadGateway)
+		log.Printf("Error reading websocket handshake from %s: %s", ws.Target, err)
 		return
 	}
 
-	defer nc.Close()
-	defer d.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		// the backend refused the upgrade, its response goes to the client as is
+		defer res.Body.Close()
+		removeHopHeaders(res.Header)
+		copyHeader(w.Header(), res.Header)
+		w.WriteHeader(res.StatusCode)
+		io.Copy(w, res.Body)
+		return
+	}
+
+	if !strings.EqualFold(res.Header.Get("Upgrade"), outreq.Header.Get("Upgrade")) || !hasToken(res.Header, "Connection", "upgrade") {
+		http.Error(w, "Invalid handshake from backend server.", http.StatusBadGateway)
+		log.Printf("Invalid websocket handshake from %s: Upgrade %q, Connection %q", ws.Target, res.Header.Get("Upgrade"), res.Header.Get("Connection"))
+		return
+	}
 
-	err = r.Write(d)
+	if ExtendedConnect(r) && res.Header.Get("Sec-Websocket-Accept") != AcceptKey(outreq.Header.Get("Sec-Websocket-Key")) {
+		http.Error(w, "Invalid handshake from backend server.", http.StatusBadGateway)
+		log.Printf("Invalid websocket handshake from %s: Sec-WebSocket-Accept %q", ws.Target, res.Header.Get("Sec-Websocket-Accept"))
+		return
+	}
+
+	d.SetDeadline(time.Time{})
+
+	deflate := hasExtension(res.Header, "permessage-deflate")
+
+	nc, buffered, err := accept(w, r, res)
 	if err != nil {
-		log.Printf("Error copying request to target: %v", err)
+		log.Printf("Error accepting connection from client: %v", err)
 		return
 	}
 
-	errc := make(chan error, 2)
-	cp := func(dst io.Writer, src io.Reader) {
-		_, err := io.Copy(dst, src)
+	defer nc.Close()
+
+	var (
+		sp      = &splice{idle: ws.IdleTimeout}
+		session = &Session{Request: r, Upstream: ws.Target, Start: time.Now(), splice: sp, client: nc, backend: d}
+		up      = &stream{src: nc, dst: d, w: d, count: &session.up}
+		down    = &stream{src: d, dst: nc, w: nc, count: &session.down}
+		done    = make(chan struct{})
+	)
+
+	// data read ahead by either side's buffer must not be lost
+	up.r = io.MultiReader(buffered, nc)
+	down.r = io.MultiReader(io.LimitReader(br, int64(br.Buffered())), d)
 
-		if err != nil {
-			errc <- err
+	if IsWebsocket(r) {
+		toBackend := &pinger{w: d, masked: true}
+		toClient := &pinger{w: nc}
+		up.w, down.w = toBackend, toClient
+		session.toBackend, session.toClient = toBackend, toClient
+
+		if ws.KeepAlive > 0 {
+			go keepalive(ws.KeepAlive, done, toBackend, toClient)
 		}
 	}
-	go cp(d, nc)
-	go cp(nc, d)
-	<-errc
+
+	if ws.Inspect != nil && IsWebsocket(r) {
+		report := func(m Message) { ws.Inspect(r, m) }
+		up.w = newInspector(up.w, true, deflate, report)
+		down.w = newInspector(down.w, false, deflate, report)
+	}
+
+	if ws.Wrap != nil {
+		up.w = ws.Wrap(r, up.w, true)
+		down.w = ws.Wrap(r, down.w, false)
+	}
+
+	if ws.Track != nil {
+		ws.Track(session, true)
+		defer ws.Track(session, false)
+	}
+
+	sp.run(up, down)
+	close(done)
 }
 
-//IsWebsocket determines whether or not an http request is using websocket
-func IsWebsocket(r *http.Request) bool {
-	connHdr := ""
-	connHdrs := r.Header["Connection"]
-	if len(connHdrs) > 0 {
-		connHdr = connHdrs[0]
+//accept completes the handshake with the client; it returns the client connection and data the client already sent
+func accept(w http.ResponseWriter, r *http.Request, res *http.Response) (net.Conn, io.Reader, error) {
+	upgrade := res.Header.Get("Upgrade")
+	removeHopHeaders(res.Header)
+
+	if ExtendedConnect(r) {
+		// the client did not send a key, the stream is accepted by its status
+		res.Header.Del("Sec-Websocket-Accept")
+		nc, err := AcceptStream(w, r, res.Header)
+
+		return nc, strings.NewReader(""), err
 	}
 
-	upgradeWs := false
-	if strings.ToLower(connHdr) == "upgrade" {
-		upgradeHdrs := r.Header["Upgrade"]
-		if len(upgradeHdrs) > 0 {
-			upgradeWs = (strings.ToLower(upgradeHdrs[0]) == "websocket")
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Not a hijacker?", http.StatusInternalServerError)
+		return nil, nil, errors.New("not a hijacker")
+	}
+
+	nc, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// deadlines the server may have set are ours to manage from now on
+	nc.SetDeadline(time.Time{})
+
+	res.Header.Set("Connection", "Upgrade")
+	res.Header.Set("Upgrade", upgrade)
+
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\n")
+	res.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if err = brw.Flush(); err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+
+	return nc, io.LimitReader(brw.Reader, int64(brw.Reader.Buffered())), nil
+}
+
+func (ws *ReverseProxy) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: ws.DialTimeout}
+
+	if ws.URL != nil && (ws.URL.Scheme == "wss" || ws.URL.Scheme == "https") {
+		return tls.DialWithDialer(dialer, "tcp", ws.Target, &tls.Config{ServerName: ws.URL.Hostname()})
+	}
+
+	return dialer.Dial("tcp", ws.Target)
+}
+
+//outgoing rewrites r for the backend the way httputil.ReverseProxy does: url and Host of the destination, X-Forwarded-* headers
+func (ws *ReverseProxy) outgoing(r *http.Request) *http.Request {
+	outreq := r.Clone(r.Context())
+	outreq.RequestURI = ""
+	outreq.Body = nil
+	outreq.ContentLength = 0
+	outreq.Close = false
+
+	outreq.URL.Scheme = "http"
+	outreq.URL.Host = ws.Target
+	outreq.Host = ws.Target
+
+	if ws.URL != nil {
+		outreq.URL.Host = ws.URL.Host
+		outreq.Host = ws.URL.Host
+		outreq.URL.Path, outreq.URL.RawPath = joinURLPath(ws.URL, r.URL)
+
+		if ws.URL.RawQuery == "" || r.URL.RawQuery == "" {
+			outreq.URL.RawQuery = ws.URL.RawQuery + r.URL.RawQuery
+		} else {
+			outreq.URL.RawQuery = ws.URL.RawQuery + "&" + r.URL.RawQuery
+		}
+	}
+
+	// headers the upgrade depends on, e.g. HTTP2-Settings for h2c, are listed in Connection and must reach the backend
+	connection := []string{"Upgrade"}
+	kept := make(http.Header)
+	for _, v := range r.Header["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if values, ok := r.Header[name]; ok && !isHopHeader(name) {
+				connection = append(connection, name)
+				kept[name] = values
+			}
 		}
 	}
 
-	return upgradeWs
+	if ExtendedConnect(r) {
+		// the backend gets the HTTP/1.1 handshake of a websocket opened over HTTP/2
+		outreq.Method = http.MethodGet
+		outreq.Header.Del(":protocol")
+		outreq.Header.Set("Sec-Websocket-Key", newKey())
+	}
+
+	upgrade := Upgrade(r)
+	removeHopHeaders(outreq.Header)
+	copyHeader(outreq.Header, kept)
+	outreq.Header.Set("Connection", strings.Join(connection, ", "))
+	outreq.Header.Set("Upgrade", upgrade)
+
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header["X-Forwarded-For"]; len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		outreq.Header.Set("X-Forwarded-For", ip)
+	}
+
+	if _, ok := outreq.Header["User-Agent"]; !ok {
+		// keep Request.Write from adding its own
+		outreq.Header.Set("User-Agent", "")
+	}
+
+	outreq.Header.Set("X-Forwarded-Host", r.Host)
+	if r.TLS != nil {
+		outreq.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		outreq.Header.Set("X-Forwarded-Proto", "http")
+	}
+
+	return outreq
+}
+
+//joinURLPath joins the paths of the destination and of the request, as httputil does
+func joinURLPath(a, b *url.URL) (path, rawpath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+
+	apath := a.EscapedPath()
+	bpath := b.EscapedPath()
+
+	aslash := strings.HasSuffix(apath, "/")
+	bslash := strings.HasPrefix(bpath, "/")
+
+	switch {
+	case aslash && bslash:
+		return a.Path + b.Path[1:], apath + bpath[1:]
+	case !aslash && !bslash:
+		return a.Path + "/" + b.Path, apath + "/" + bpath
+	}
+
+	return a.Path + b.Path, apath + bpath
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+
+	return a + b
+}
+
+func removeHopHeaders(h http.Header) {
+	// headers listed in Connection are hop-by-hop as well
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+func isHopHeader(name string) bool {
+	for _, h := range hopHeaders {
+		if h == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+//hasToken reports whether a comma separated header contains token, ignoring case
+func hasToken(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//hasExtension reports whether a websocket extension has been negotiated, whatever its parameters
+func hasExtension(h http.Header, name string) bool {
+	for _, v := range h["Sec-Websocket-Extensions"] {
+		for _, ext := range strings.Split(v, ",") {
+			if i := strings.Index(ext, ";"); i >= 0 {
+				ext = ext[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(ext), name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//Upgrade returns the protocol a request asks to switch to, or to open an HTTP/2 stream with, or an empty string when it asks for neither
+func Upgrade(r *http.Request) string {
+	if ExtendedConnect(r) {
+		return r.Header.Get(":protocol")
+	}
+
+	if !hasToken(r.Header, "Connection", "upgrade") {
+		return ""
+	}
+
+	return strings.TrimSpace(r.Header.Get("Upgrade"))
+}
+
+//IsWebsocket determines whether or not an http request is using websocket, over HTTP/1.1 or HTTP/2
+func IsWebsocket(r *http.Request) bool {
+	if ExtendedConnect(r) {
+		return strings.EqualFold(r.Header.Get(":protocol"), "websocket")
+	}
+
+	return Upgrade(r) != "" && hasToken(r.Header, "Upgrade", "websocket")
 }
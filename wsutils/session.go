@@ -0,0 +1,107 @@
+package wsutils
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// sendTimeout is how long Send waits for the message being written to the client to end
+const sendTimeout = 5 * time.Second
+
+var (
+	// ErrClosed is returned when sending to a session which is being closed
+	ErrClosed = errors.New("websocket closed")
+
+	// ErrNotWebsocket is returned when sending to an upgraded connection which is not a websocket
+	ErrNotWebsocket = errors.New("not a websocket")
+
+	// ErrBusy is returned when a message could not be sent in between the messages of the backend
+	ErrBusy = errors.New("websocket busy")
+)
+
+// Session represents a connection established by a ReverseProxy
+type Session struct {
+	Request  *http.Request
+	Upstream string
+	Start    time.Time
+
+	up        int64
+	down      int64
+	splice    *splice
+	client    net.Conn
+	backend   net.Conn
+	toClient  *pinger // websockets only
+	toBackend *pinger
+}
+
+// BytesUp returns the number of bytes sent by the client to the backend so far
+func (s *Session) BytesUp() int64 {
+	return atomic.LoadInt64(&s.up)
+}
+
+// BytesDown returns the number of bytes sent by the backend to the client so far
+func (s *Session) BytesDown() int64 {
+	return atomic.LoadInt64(&s.down)
+}
+
+// Close ends s: websockets get a close frame on both sides and a grace period to complete the closing handshake, other connections are closed at once
+func (s *Session) Close(code int, reason string) {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+
+	// each side answers its own close frame, answers must not be relayed to the other side
+	s.splice.stop()
+
+	sent := false
+	if s.toClient != nil {
+		for _, p := range []*pinger{s.toClient, s.toBackend} {
+			if ok, _ := p.control(0x8, payload); ok {
+				sent = true
+			}
+		}
+	}
+
+	if !sent {
+		s.client.Close()
+		s.backend.Close()
+		return
+	}
+
+	s.splice.shutdown(s.client, s.backend)
+}
+
+// Send writes a message to the client as if the backend had sent it, in between the messages of the backend
+func (s *Session) Send(binary bool, payload []byte) error {
+	if s.toClient == nil {
+		return ErrNotWebsocket
+	}
+
+	opcode := byte(0x1)
+	if binary {
+		opcode = 0x2
+	}
+
+	deadline := time.Now().Add(sendTimeout)
+	for {
+		n, err := s.toClient.message(opcode, payload)
+		if err != nil {
+			return err
+		} else if n > 0 {
+			atomic.AddInt64(&s.down, int64(n))
+			return nil
+		} else if time.Now().After(deadline) {
+			return ErrBusy
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
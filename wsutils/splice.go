@@ -0,0 +1,208 @@
+package wsutils
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// closeGrace is how long the remaining direction may go on once the other one has ended
+const closeGrace = 5 * time.Second
+
+// splice copies data both ways between a client and a backend until both directions have ended
+type splice struct {
+	idle    time.Duration
+	last    int64 // unix nano of the last read in either direction
+	closing int64 // unix nano of the end of the first direction, 0 while both are open
+	stopped int32 // set once data is no longer relayed, only drained
+}
+
+// stream is one direction of a splice
+type stream struct {
+	src   net.Conn
+	r     io.Reader // reads src, including data buffered before the splice started
+	dst   net.Conn
+	w     io.Writer // writes dst, possibly wrapped
+	count *int64    // bytes copied, updated atomically
+}
+
+func (s *splice) run(up, down *stream) {
+	var wg sync.WaitGroup
+
+	atomic.StoreInt64(&s.last, time.Now().UnixNano())
+
+	wg.Add(2)
+	for _, pair := range [][2]*stream{{up, down}, {down, up}} {
+		go func(st, other *stream) {
+			defer wg.Done()
+
+			if err := s.copy(st); err != nil {
+				// a failed direction takes the other one down instead of leaving it hanging
+				st.src.Close()
+				other.src.Close()
+				return
+			}
+
+			// the peer gets EOF while data may still flow the other way, for a while
+			atomic.CompareAndSwapInt64(&s.closing, 0, time.Now().UnixNano())
+			closeWrite(st.dst)
+			other.src.SetReadDeadline(time.Now().Add(closeGrace))
+		}(pair[0], pair[1])
+	}
+
+	wg.Wait()
+}
+
+// copy moves data from src to dst; it returns nil on a clean EOF
+func (s *splice) copy(st *stream) error {
+	buf := make([]byte, 32*1024)
+
+	for {
+		s.deadline(st.src)
+
+		n, err := st.r.Read(buf)
+		if n > 0 && atomic.LoadInt32(&s.stopped) == 0 {
+			atomic.StoreInt64(&s.last, time.Now().UnixNano())
+			if _, werr := st.w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if st.count != nil {
+				atomic.AddInt64(st.count, int64(n))
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && s.alive() {
+				continue
+			}
+			return err
+		}
+	}
+}
+
+// deadline sets the read deadline of c according to the idle timeout and to the end of the other direction
+func (s *splice) deadline(c net.Conn) {
+	var deadline time.Time
+
+	if closing := atomic.LoadInt64(&s.closing); closing != 0 {
+		deadline = time.Unix(0, closing).Add(closeGrace)
+	} else if s.idle > 0 {
+		deadline = time.Now().Add(s.idle)
+	} else {
+		return
+	}
+
+	c.SetReadDeadline(deadline)
+}
+
+// alive reports whether a read timeout should be ignored because the connection is still in use
+func (s *splice) alive() bool {
+	if atomic.LoadInt64(&s.closing) != 0 {
+		return false
+	}
+
+	return s.idle > 0 && time.Since(time.Unix(0, atomic.LoadInt64(&s.last))) < s.idle
+}
+
+// stop ends relaying: whatever is read afterwards is dropped
+func (s *splice) stop() {
+	atomic.StoreInt32(&s.stopped, 1)
+}
+
+// shutdown gives both directions closeGrace to end before their connections are closed
+func (s *splice) shutdown(conns ...net.Conn) {
+	atomic.CompareAndSwapInt64(&s.closing, 0, time.Now().UnixNano())
+
+	for _, c := range conns {
+		c.SetReadDeadline(time.Now().Add(closeGrace))
+	}
+}
+
+// closeWrite half-closes c when supported, otherwise it closes c
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		if cw.CloseWrite() == nil {
+			return
+		}
+	}
+
+	c.Close()
+}
+
+// pinger writes websocket frames to a connection and slips ping frames in between them
+type pinger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	frames MessageCounter
+	masked bool
+	closed bool // nothing may follow a close frame
+}
+
+func (p *pinger) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n, err := p.w.Write(b)
+	p.frames.Count(b[:n])
+
+	return n, err
+}
+
+// ping sends a ping frame unless a frame is being written
+func (p *pinger) ping() error {
+	_, err := p.control(0x9, nil)
+
+	return err
+}
+
+// control sends a control frame, whose payload is at most 125 bytes, when no frame is being written
+func (p *pinger) control(opcode byte, payload []byte) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || !p.frames.Boundary() {
+		return false, nil
+	}
+	p.closed = opcode == 0x8
+
+	_, err := p.w.Write(AppendFrame(nil, opcode, payload, p.masked))
+
+	return err == nil, err
+}
+
+// message sends a data message when no other message is being written; it returns the size of the frame sent, 0 when it must be retried
+func (p *pinger) message(opcode byte, payload []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return 0, ErrClosed
+	} else if !p.frames.BetweenMessages() {
+		return 0, nil
+	}
+
+	return p.w.Write(AppendFrame(nil, opcode, payload, p.masked))
+}
+
+// keepalive pings both pingers at interval until done is closed
+func keepalive(interval time.Duration, done chan struct{}, pingers ...*pinger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, p := range pingers {
+				p.ping()
+			}
+		case <-done:
+			return
+		}
+	}
+}
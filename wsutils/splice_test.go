@@ -0,0 +1,209 @@
+package wsutils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"testing"
+	"time"
+)
+
+const testKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+// acceptKey answers the Sec-WebSocket-Key of a handshake
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// textFrame returns a final text frame, masked when sent by a client
+func textFrame(payload string, masked bool) []byte {
+	if !masked {
+		return append([]byte{0x81, byte(len(payload))}, payload...)
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x81, 0x80 | byte(len(payload))}, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+
+	return frame
+}
+
+// backendFunc is run on each connection of a fake backend once the upgrade has been answered
+type backendFunc func(c net.Conn, br *bufio.Reader)
+
+// startBackend answers websocket upgrades then hands connections to fn, it is closed with the test
+func startBackend(t *testing.T, fn backendFunc) *url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+
+				br := bufio.NewReader(c)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+
+				io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: "+acceptKey(req.Header.Get("Sec-Websocket-Key"))+"\r\n\r\n")
+				fn(c, br)
+			}()
+		}
+	}()
+
+	return &url.URL{Scheme: "ws", Host: l.Addr().String()}
+}
+
+// startProxy serves proxy and returns its address and a channel closed when a ServeHTTP call returns
+func startProxy(t *testing.T, proxy *ReverseProxy) (string, chan struct{}) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server.Listener.Addr().String(), done
+}
+
+// dial opens a websocket through the proxy at addr
+func dial(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	io.WriteString(c, "GET /socket HTTP/1.1\r\nHost: "+addr+"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: "+testKey+"\r\nSec-WebSocket-Version: 13\r\n\r\n")
+
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status 101, got %d", res.StatusCode)
+	}
+
+	return c, br
+}
+
+// waitServed fails the test when ServeHTTP has not returned within timeout
+func waitServed(t *testing.T, done chan struct{}, timeout time.Duration) {
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatalf("ServeHTTP did not return within %s", timeout)
+	}
+}
+
+// checkGoroutines fails the test when the number of goroutines does not get back to baseline
+func checkGoroutines(t *testing.T, baseline int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines left, expected %d\n%s", runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientCloses(t *testing.T) {
+	backend := startBackend(t, func(c net.Conn, br *bufio.Reader) {
+		io.Copy(io.Discard, br)
+	})
+	addr, done := startProxy(t, NewReverseProxy(backend))
+	baseline := runtime.NumGoroutine()
+
+	c, _ := dial(t, addr)
+	c.Write(textFrame("hello", true))
+	c.Close()
+
+	waitServed(t, done, time.Second)
+	checkGoroutines(t, baseline)
+}
+
+func TestBackendCloses(t *testing.T) {
+	backend := startBackend(t, func(c net.Conn, br *bufio.Reader) {
+		c.Write(textFrame("bye", false))
+	})
+	addr, done := startProxy(t, NewReverseProxy(backend))
+	baseline := runtime.NumGoroutine()
+
+	c, br := dial(t, addr)
+	defer c.Close()
+
+	f := make([]byte, 5)
+	if _, err := io.ReadFull(br, f); err != nil || string(f) != string(textFrame("bye", false)) {
+		t.Fatalf("expected the frame of the backend, got %q %v", f, err)
+	}
+
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("expected EOF once the backend closed, got %v", err)
+	}
+
+	c.Close()
+
+	waitServed(t, done, time.Second)
+	checkGoroutines(t, baseline)
+}
+
+// the client never closes its end: the connection must end once closeGrace is over
+func TestBackendClosesGrace(t *testing.T) {
+	backend := startBackend(t, func(c net.Conn, br *bufio.Reader) {})
+	addr, done := startProxy(t, NewReverseProxy(backend))
+	baseline := runtime.NumGoroutine()
+
+	c, br := dial(t, addr)
+	defer c.Close()
+
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("expected EOF once the backend closed, got %v", err)
+	}
+
+	start := time.Now()
+	waitServed(t, done, closeGrace+time.Second)
+	if elapsed := time.Since(start); elapsed < closeGrace/2 {
+		t.Fatalf("connection closed after %s, before the grace period", elapsed)
+	}
+
+	c.Close()
+	checkGoroutines(t, baseline)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	backend := startBackend(t, func(c net.Conn, br *bufio.Reader) {
+		io.Copy(io.Discard, br)
+	})
+	proxy := NewReverseProxy(backend)
+	proxy.IdleTimeout = 200 * time.Millisecond
+	addr, done := startProxy(t, proxy)
+	baseline := runtime.NumGoroutine()
+
+	c, _ := dial(t, addr)
+	defer c.Close()
+
+	waitServed(t, done, time.Second)
+	c.Close()
+	checkGoroutines(t, baseline)
+}
@@ -0,0 +1,56 @@
+// Package xconnect enables the extended CONNECT protocol (RFC 8441) of the HTTP/2 server of net/http, which
+// websockets over HTTP/2 rely on. net/http only enables it when GODEBUG contains http2xconnect=1 as it initializes,
+// so this package must be imported by main before anything importing net/http is initialized; as it only depends
+// on os and strings, and its path sorts before net/http, it is initialized first.
+package xconnect
+
+import (
+	"os"
+	"strings"
+)
+
+const setting = "http2xconnect"
+
+var (
+	original string
+	defined  bool
+	enabled  bool
+	changed  bool
+)
+
+func init() {
+	original, defined = os.LookupEnv("GODEBUG")
+
+	// an explicit setting, e.g. http2xconnect=0, is left as is
+	if strings.Contains(original, setting+"=") {
+		enabled = strings.Contains(original, setting+"=1")
+		return
+	}
+
+	godebug := setting + "=1"
+	if original != "" {
+		godebug = original + "," + godebug
+	}
+
+	changed = os.Setenv("GODEBUG", godebug) == nil
+	enabled = changed
+}
+
+// Enabled reports whether websockets over HTTP/2 are accepted
+func Enabled() bool {
+	return enabled
+}
+
+// Restore sets GODEBUG back as it was, so that it is not passed on to other processes
+// It must be called once net/http has been initialized, e.g. from main
+func Restore() {
+	if !changed {
+		return
+	}
+
+	if defined {
+		os.Setenv("GODEBUG", original)
+	} else {
+		os.Unsetenv("GODEBUG")
+	}
+}